@@ -5,6 +5,9 @@ import (
 )
 
 type Config struct {
+	// JSON configuration file holding the rules
+	ConfigFile string
+
 	Refresh         time.Duration
 	Zk              string
 	LogLevel        string
@@ -16,6 +19,73 @@ type Config struct {
 	BlackList       []string
 	Separator       string
 
+	// What happens to the tasks of an app whose service name is already
+	// produced by another app
+	NameCollisions string
+
+	// Policy keeping the service names usable in DNS lookups
+	NameReplacement string
+	NameMaxLength   int
+	NameTrim        bool
+	NameStrict      bool
+
+	// How the cluster state is fetched: from the master's state or by
+	// polling every agent
+	StateMode        string
+	AgentPollWorkers int
+	AgentPollTimeout time.Duration
+
+	// Consul maintenance mode of the agents in Mesos maintenance
+	Maintenance string
+
+	// Feed the Mesos health of the tasks into Consul TTL checks
+	MesosHealth bool
+
+	// Environment variables the check labels may expand
+	CheckEnv string
+
+	// Marathon APIs used to turn app health checks into Consul checks,
+	// and whose events trigger syncs
+	Marathon               string
+	MarathonEvents         bool
+	MarathonEventsInterval time.Duration
+	MarathonAuth           string
+	MarathonSSLVerify      bool
+	MarathonCACert         string
+	MarathonTimeout        time.Duration
+
+	// Mapping of the Mesos agents to their Consul agent
+	ConsulAgentTemplate  string
+	ConsulAgentTable     string
+	ConsulAgentDiscovery bool
+
+	// Tasks registered, and whether the visibility of their discovery
+	// info is ignored
+	RegistrationMode  string
+	RegistrationLabel string
+	IgnoreVisibility  bool
+
+	// Labels turned into tags
+	TagLabelPrefix string
+	TagLabels      string
+	DiscoveryTags  bool
+
+	// Where the task versions come from, and the tag and meta key they
+	// are exposed as
+	VersionSources string
+	VersionTag     string
+	VersionMeta    string
+
+	// Add the container image to the tags
+	ContainerTags bool
+
+	// Include the task resources in the change detection
+	ResourceChanges bool
+
+	// Give the tasks an instance index, unless set with the label
+	InstanceIndex bool
+	InstanceLabel string
+
 	// Mesos service name and tags
 	ServiceName string
 	ServiceTags string
@@ -23,16 +93,29 @@ type Config struct {
 
 func DefaultConfig() *Config {
 	return &Config{
-		Refresh:         time.Minute,
-		Zk:              "zk://127.0.0.1:2181/mesos",
-		MesosIpOrder:    "netinfo,mesos,host",
-		Healthcheck:     false,
-		HealthcheckIp:   "127.0.0.1",
-		HealthcheckPort: "24476",
-		WhiteList:       []string{},
-		BlackList:       []string{},
-		Separator:       "",
-		ServiceName:     "mesos",
-		ServiceTags:     "",
+		Refresh:           time.Minute,
+		Zk:                "zk://127.0.0.1:2181/mesos",
+		MesosIpOrder:      "netinfo,mesos,host",
+		Healthcheck:       false,
+		HealthcheckIp:     "127.0.0.1",
+		HealthcheckPort:   "24476",
+		WhiteList:         []string{},
+		BlackList:         []string{},
+		Separator:         "",
+		NameCollisions:    "warn",
+		NameReplacement:   "-",
+		StateMode:         "master",
+		AgentPollWorkers:  10,
+		AgentPollTimeout:  5 * time.Second,
+		Maintenance:       "off",
+		MarathonSSLVerify: true,
+		MarathonTimeout:   10 * time.Second,
+		RegistrationMode:  "all",
+		RegistrationLabel: "consul=true",
+		VersionTag:        "{version}",
+		VersionMeta:       "version",
+		InstanceLabel:     "consul_instance",
+		ServiceName:       "mesos",
+		ServiceTags:       "",
 	}
 }
@@ -0,0 +1,159 @@
+package consul
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// agent holds the client of a Consul agent along with its health. An agent
+// that failed too many times in a row is considered down until the
+// cooldown expires, then it gets a single chance to prove it's back.
+type agent struct {
+	client      *consulapi.Client
+	failures    int
+	lastFailure time.Time
+}
+
+// newTransport()
+//   Build the HTTP transport shared by all the agent clients
+//
+func newTransport(cfg consulConfig) *http.Transport {
+	t := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   cfg.timeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConns:        cfg.maxIdleConns,
+		MaxIdleConnsPerHost: cfg.maxIdleConnsPerHost,
+		IdleConnTimeout:     cfg.idleConnTimeout,
+	}
+
+	if !cfg.sslVerify {
+		log.Debugf("disabled SSL verification")
+		t.TLSClientConfig = &tls.Config{
+			InsecureSkipVerify: true,
+		}
+	}
+
+	return t
+}
+
+// agentDown()
+//   Check whether the agent is known to be down
+//
+func (c *Consul) agentDown(address string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	a, ok := c.agents[address]
+	if !ok || a.failures < c.config.agentFailures {
+		return false
+	}
+
+	return time.Since(a.lastFailure) < c.config.agentCooldown
+}
+
+// agentResult()
+//   Record the outcome of a request to the agent. Requests the agent
+//   refused as invalid don't count against its health.
+//
+func (c *Consul) agentResult(address string, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	a, ok := c.agents[address]
+	if !ok {
+		return
+	}
+
+	if !agentFailure(err) {
+		if a.failures >= c.config.agentFailures {
+			log.Infof("Consul agent %s is back", address)
+		}
+		a.failures = 0
+		return
+	}
+
+	a.failures++
+	a.lastFailure = time.Now()
+	if a.failures == c.config.agentFailures {
+		log.Warnf("Consul agent %s is down after %d failures", address, a.failures)
+	}
+}
+
+// agentFailure()
+//   Check whether the error shows the agent is failing: the request
+//   didn't reach it, or it answered with a server error
+//
+func agentFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	code, ok := responseCode(err)
+	return !ok || code >= 500
+}
+
+// responseCode()
+//   Return the HTTP status code of an error returned by the Consul API
+//   for a response other than 200
+//
+func responseCode(err error) (int, bool) {
+	var code int
+	if _, e := fmt.Sscanf(err.Error(), "Unexpected response code: %d", &code); e != nil {
+		return 0, false
+	}
+
+	return code, true
+}
+
+// errAgentDown()
+//   Error returned instead of talking to an agent known to be down
+//
+func errAgentDown(address string) error {
+	stats.Add("agent_skips", 1)
+	return fmt.Errorf("Consul agent %s is down", address)
+}
+
+// evictAgents()
+//   Drop the clients of the agents no cached service is registered on
+//   anymore
+//
+func (c *Consul) evictAgents() {
+	used := make(map[string]bool)
+	for _, e := range cacheEntries() {
+		used[e.agent] = true
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for address := range c.agents {
+		if !used[address] {
+			log.Debugf("Dropping client of Consul agent %s", address)
+			delete(c.agents, address)
+		}
+	}
+}
+
+func (c *Consul) agentsDown() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	n := 0
+	for _, a := range c.agents {
+		if a.failures >= c.config.agentFailures {
+			n++
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,218 @@
+package consul
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// fakeAgent is a Consul agent recording the requests it answers
+type fakeAgent struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	requests []string
+}
+
+func newFakeAgent() *fakeAgent {
+	a := &fakeAgent{}
+	a.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.lock.Lock()
+		a.requests = append(a.requests, r.Method+" "+r.URL.Path)
+		a.lock.Unlock()
+
+		w.Write([]byte("true"))
+	}))
+
+	return a
+}
+
+func (a *fakeAgent) address() string {
+	return a.Listener.Addr().String()
+}
+
+func (a *fakeAgent) received() []string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return append([]string(nil), a.requests...)
+}
+
+// deadAgent()
+//   Return the address of an agent refusing connections
+//
+func deadAgent(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	return l.Addr().String()
+}
+
+func newTestConsul() *Consul {
+	c := &Consul{
+		agents: make(map[string]*agent),
+		config: consulConfig{
+			agentFailures: 2,
+			agentCooldown: time.Minute,
+			fallbackAfter: 2,
+		},
+		httpClient:      &http.Client{Timeout: time.Second},
+		nodeMaintenance: make(map[string]string),
+	}
+	c.retries = newRetryQueue(time.Second, time.Second)
+
+	return c
+}
+
+func testEntry(agent string) *cacheEntry {
+	return newCacheEntry(&consulapi.AgentServiceRegistration{
+		ID:   "web:31000",
+		Name: "web",
+		Port: 31000,
+	}, agent, "10.0.0.1")
+}
+
+func TestAgentHealth(t *testing.T) {
+	c := newTestConsul()
+	c.client("10.0.0.1")
+
+	c.agentResult("10.0.0.1", errors.New("connection refused"))
+	if c.agentDown("10.0.0.1") {
+		t.Error("agent down after a single failure")
+	}
+
+	// A request refused by a responding agent shows it's up
+	c.agentResult("10.0.0.1", errors.New("Unexpected response code: 400 (invalid service)"))
+	c.agentResult("10.0.0.1", errors.New("connection refused"))
+	if c.agentDown("10.0.0.1") {
+		t.Error("agent down although it responded in between")
+	}
+
+	// Server errors count as failures
+	c.agentResult("10.0.0.1", errors.New("Unexpected response code: 500 (rpc error)"))
+	if !c.agentDown("10.0.0.1") {
+		t.Error("agent not down after 2 failures")
+	}
+	if n := c.agentsDown(); n != 1 {
+		t.Errorf("got %d agents down, want 1", n)
+	}
+
+	// The agent gets a chance once the cooldown expired
+	c.agents["10.0.0.1"].lastFailure = time.Now().Add(-2 * time.Minute)
+	if c.agentDown("10.0.0.1") {
+		t.Error("agent still down after the cooldown")
+	}
+
+	c.agentResult("10.0.0.1", nil)
+	if n := c.agentsDown(); n != 0 {
+		t.Errorf("got %d agents down after a success, want 0", n)
+	}
+
+	// Unknown agents are neither tracked nor down
+	c.agentResult("10.0.0.2", errors.New("connection refused"))
+	if _, ok := c.agents["10.0.0.2"]; ok || c.agentDown("10.0.0.2") {
+		t.Error("unknown agent tracked")
+	}
+}
+
+func TestSyncEntry_AgentFailures(t *testing.T) {
+	c := newTestConsul()
+	dead := deadAgent(t)
+
+	e := testEntry(dead)
+	for i := 0; i < c.config.agentFailures; i++ {
+		if err := c.syncEntry(e); err == nil {
+			t.Fatalf("attempt #%d: registered on a dead agent", i)
+		}
+	}
+
+	if !c.agentDown(dead) {
+		t.Error("agent not down after failed registrations")
+	}
+	if e.registered {
+		t.Error("entry registered on a dead agent")
+	}
+}
+
+func TestSyncEntry_ServerError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "rpc error", http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	c := newTestConsul()
+	address := ts.Listener.Addr().String()
+
+	e := testEntry(address)
+	for i := 0; i < c.config.agentFailures; i++ {
+		if err := c.syncEntry(e); err == nil {
+			t.Fatalf("attempt #%d: registered on a failing agent", i)
+		}
+	}
+
+	if !c.agentDown(address) {
+		t.Error("agent answering 500 not down after failed registrations")
+	}
+}
+
+func TestSyncEntry_SkipsDeadAgent(t *testing.T) {
+	c := newTestConsul()
+	fake := newFakeAgent()
+	defer fake.Close()
+
+	c.client(fake.address())
+	c.agents[fake.address()].failures = c.config.agentFailures
+	c.agents[fake.address()].lastFailure = time.Now()
+
+	e := testEntry(fake.address())
+	if err := c.syncEntry(e); err == nil || err.Error() != errAgentDown(fake.address()).Error() {
+		t.Errorf("got error %v, want the agent down", err)
+	}
+	if reqs := fake.received(); len(reqs) != 0 {
+		t.Errorf("agent known down got requests %v", reqs)
+	}
+	if e.registered || e.upstream {
+		t.Error("entry marked registered on an agent known down")
+	}
+
+	// Once the cooldown expired, the registration goes through
+	c.agents[fake.address()].lastFailure = time.Now().Add(-2 * time.Minute)
+	if err := c.syncEntry(e); err != nil {
+		t.Fatalf("got error %v after the cooldown", err)
+	}
+	if !e.registered || !e.upstream || c.agentDown(fake.address()) {
+		t.Error("entry not registered after the cooldown")
+	}
+	if reqs := fake.received(); len(reqs) != 2 || reqs[0] != "PUT /v1/agent/service/register" {
+		t.Errorf("got requests %v, want the registration and upstream key", reqs)
+	}
+}
+
+func TestEvictAgents(t *testing.T) {
+	serviceCache = map[string]*cacheEntry{
+		"web:31000": testEntry("10.0.0.1"),
+	}
+	defer func() { serviceCache = nil }()
+
+	c := newTestConsul()
+	c.client("10.0.0.1")
+	c.client("10.0.0.2")
+
+	c.evictAgents()
+
+	if _, ok := c.agents["10.0.0.1"]; !ok {
+		t.Error("dropped the client of an agent in use")
+	}
+	if _, ok := c.agents["10.0.0.2"]; ok {
+		t.Error("kept the client of an unused agent")
+	}
+}
@@ -2,6 +2,7 @@ package consul
 
 import (
 	"strings"
+	"sync"
 
 	"github.com/mesos-utility/mesos-consul/registry"
 
@@ -13,11 +14,27 @@ type cacheEntry struct {
 	service         *consulapi.AgentServiceRegistration
 	agent           string
 	validityCounter int
+
+	// Mesos agent or master IP naming the nginx upstream key
+	host string
+
+	// Registration steps completed on the agent. external is set while
+	// the service is registered through the central Consul instead.
+	registered bool
+	external   bool
+	upstream   bool
+
+	// Reason of the maintenance enabled by mesos-consul
+	maintenance string
+
+	// Mesos health fed into the TTL check of the service
+	health string
 }
 
-func newCacheEntry(service *consulapi.AgentServiceRegistration, agent string) *cacheEntry {
+func newCacheEntry(service *consulapi.AgentServiceRegistration, agent, host string) *cacheEntry {
 	return &cacheEntry{
 		agent:           agent,
+		host:            host,
 		service:         service,
 		validityCounter: 0,
 	}
@@ -27,9 +44,16 @@ func newCacheEntry(service *consulapi.AgentServiceRegistration, agent string) *c
 var serviceCache map[string]*cacheEntry
 var cacheEntryValidityThreshold int = 1
 
+// cacheLock guards serviceCache, which is updated by the registration
+// workers
+var cacheLock sync.RWMutex
+
 // CacheCreate()
 //
 func (c *Consul) CacheCreate() bool {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+
 	if serviceCache == nil {
 		serviceCache = make(map[string]*cacheEntry)
 		return true
@@ -48,6 +72,8 @@ func (c *Consul) CacheLoad(host string) error {
 		return err
 	}
 
+	nodes := make(map[string]string)
+
 	for service, _ := range serviceList {
 		catalogServices, _, err := client.Service(service, "", nil)
 		if err != nil {
@@ -55,25 +81,70 @@ func (c *Consul) CacheLoad(host string) error {
 		}
 
 		for _, s := range catalogServices {
+			nodes[s.Node] = s.Address
 			if strings.HasPrefix(s.ServiceID, "mesos-consul:") {
 				log.Debugf("Found '%s' with ID '%s'", s.ServiceName, s.ServiceID)
-				serviceCache[s.ServiceID] = newCacheEntry(&consulapi.AgentServiceRegistration{
+				e := newCacheEntry(&consulapi.AgentServiceRegistration{
 					ID:      s.ServiceID,
 					Name:    s.ServiceName,
 					Port:    s.ServicePort,
 					Address: s.ServiceAddress,
 					Tags:    s.ServiceTags,
-				}, s.Address)
+					Meta:    s.ServiceMeta,
+				}, c.agentKey(s.Node, s.Address), serviceHost(s))
+				if strings.HasPrefix(s.Node, fallbackNodePrefix) {
+					e.external = true
+				} else {
+					e.registered = true
+				}
+				e.upstream = true
+
+				if prev, ok := cacheGet(s.ServiceID); ok {
+					e.registered = e.registered || prev.registered
+					e.external = e.external || prev.external
+				}
+				cachePut(s.ServiceID, e)
+
+				// Move fallback registrations back to their agent
+				if e.external {
+					c.retries.failed(s.ServiceID)
+				}
 			}
 		}
 	}
 
+	if err := c.loadMaintenance(host, nodes); err != nil {
+		log.Warn("Unable to load the maintenance checks: ", err)
+	}
+
 	return nil
 }
 
+// serviceHost()
+//   Return the Mesos agent or master IP the service was registered for.
+//   The IDs of the task services start with the agent IP, while the Mesos
+//   services are registered at the address of their host.
+//
+func serviceHost(s *consulapi.CatalogService) string {
+	parts := strings.Split(s.ServiceID, ":")
+	if len(parts) < 2 || parts[1] == s.ServiceName {
+		return s.ServiceAddress
+	}
+
+	// mesos-consul:<agent>-<task> for the tasks without ports
+	if len(parts) == 2 {
+		return strings.Split(parts[1], "-")[0]
+	}
+
+	return parts[1]
+}
+
 // CacheLookup()
 //
 func (c *Consul) CacheLookup(id string) *registry.Service {
+	cacheLock.RLock()
+	defer cacheLock.RUnlock()
+
 	if _, ok := serviceCache[id]; ok {
 		s := serviceCache[id].service
 
@@ -83,6 +154,7 @@ func (c *Consul) CacheLookup(id string) *registry.Service {
 			Port:    s.Port,
 			Address: s.Address,
 			Tags:    s.Tags,
+			Meta:    s.Meta,
 		}
 	}
 
@@ -92,6 +164,9 @@ func (c *Consul) CacheLookup(id string) *registry.Service {
 // CacheDelete()
 //
 func (c *Consul) CacheDelete(id string) {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+
 	if _, ok := serviceCache[id]; ok {
 		delete(serviceCache, id)
 	}
@@ -101,23 +176,83 @@ func (c *Consul) CacheDelete(id string) {
 //   Mark the service ID as valid
 //
 func (c *Consul) CacheMark(id string) {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+
 	if _, ok := serviceCache[id]; ok {
 		serviceCache[id].validityCounter = 0
 	}
 }
 
+// CacheMarkAgent()
+//   Mark every service registered on the agent as valid
+//
+func (c *Consul) CacheMarkAgent(agent string) {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+
+	for _, e := range serviceCache {
+		if e.agent == agent {
+			e.validityCounter = 0
+		}
+	}
+}
+
 // CacheProcessDeregister()
 //   Calculate the validity of the entry
 //
 func (c *Consul) CacheProcessDeregister(id string) {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+
 	if _, ok := serviceCache[id]; ok {
 		serviceCache[id].validityCounter++
 	}
 }
 
 func (c *Consul) CacheIsValid(id string) bool {
+	cacheLock.RLock()
+	defer cacheLock.RUnlock()
+
 	if _, ok := serviceCache[id]; ok {
 		return serviceCache[id].validityCounter < cacheEntryValidityThreshold
 	}
 	return false
 }
+
+// cacheGet()
+//   Return the cache entry of the service ID
+//
+func cacheGet(id string) (*cacheEntry, bool) {
+	cacheLock.RLock()
+	defer cacheLock.RUnlock()
+
+	e, ok := serviceCache[id]
+	return e, ok
+}
+
+// cachePut()
+//   Add or replace the cache entry of the service ID
+//
+func cachePut(id string, e *cacheEntry) {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+
+	serviceCache[id] = e
+}
+
+// cacheEntries()
+//   Return a snapshot of the cache, safe to iterate while the cache is
+//   being updated
+//
+func cacheEntries() map[string]*cacheEntry {
+	cacheLock.RLock()
+	defer cacheLock.RUnlock()
+
+	entries := make(map[string]*cacheEntry, len(serviceCache))
+	for id, e := range serviceCache {
+		entries[id] = e
+	}
+
+	return entries
+}
@@ -0,0 +1,90 @@
+package consul
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mesos-utility/mesos-consul/registry"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func TestCacheLoad_Host(t *testing.T) {
+	// The Consul agent of the Mesos agent 10.0.0.1 is node-1 at 10.1.0.1,
+	// and its fallback node holds a service registered while it was down
+	catalog := map[string][]*consulapi.CatalogService{
+		"web": {{
+			Node:           "node-1",
+			Address:        "10.1.0.1",
+			ServiceID:      "mesos-consul:10.0.0.1:web:31000",
+			ServiceName:    "web",
+			ServiceAddress: "172.17.0.2",
+			ServicePort:    31000,
+		}},
+		"api": {{
+			Node:           fallbackNode("10.1.0.1"),
+			Address:        "10.1.0.1",
+			ServiceID:      "mesos-consul:10.0.0.1-api",
+			ServiceName:    "api",
+			ServiceAddress: "172.17.0.3",
+		}},
+		"mesos": {{
+			Node:           "node-5",
+			Address:        "10.1.0.5",
+			ServiceID:      "mesos-consul:mesos:10.0.0.5:5050",
+			ServiceName:    "mesos",
+			ServiceAddress: "10.0.0.5",
+			ServicePort:    5050,
+		}},
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/catalog/services":
+			services := make(map[string][]string)
+			for name := range catalog {
+				services[name] = nil
+			}
+			json.NewEncoder(w).Encode(services)
+		case strings.HasPrefix(r.URL.Path, "/v1/catalog/service/"):
+			json.NewEncoder(w).Encode(catalog[strings.TrimPrefix(r.URL.Path, "/v1/catalog/service/")])
+		default:
+			w.Write([]byte("[]"))
+		}
+	}))
+	defer srv.Close()
+
+	serviceCache = make(map[string]*cacheEntry)
+	defer func() { serviceCache = nil }()
+
+	c := newTestConsul()
+	c.SetAgents([]*registry.Agent{
+		{IP: "10.0.0.1", Node: "node-1", Address: "10.1.0.1"},
+		{IP: "10.0.0.5", Node: "node-5", Address: "10.1.0.5"},
+	})
+	if err := c.CacheLoad(srv.Listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	for id, want := range map[string]string{
+		"mesos-consul:10.0.0.1:web:31000":  "upstreams/web/10.0.0.1:31000",
+		"mesos-consul:10.0.0.1-api":        "upstreams/api/10.0.0.1:0",
+		"mesos-consul:mesos:10.0.0.5:5050": "upstreams/mesos/10.0.0.5:5050",
+	} {
+		e, ok := cacheGet(id)
+		if !ok {
+			t.Errorf("%s not loaded", id)
+			continue
+		}
+		if key := upstreamKey(e); key != want {
+			t.Errorf("%s: got upstream key %s, want %s", id, key, want)
+		}
+	}
+
+	if e, _ := cacheGet("mesos-consul:10.0.0.1-api"); e == nil || !e.external || e.agent != "10.1.0.1" {
+		t.Errorf("fallback service not attached to its agent: %+v", e)
+	}
+}
@@ -3,6 +3,7 @@ package consul
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	flag "github.com/ogier/pflag"
 )
@@ -17,6 +18,19 @@ type consulConfig struct {
 	sslCaCert              string
 	token                  string
 	heartbeatsBeforeRemove int
+	workers                int
+	agentRate              float64
+	timeout                time.Duration
+	retryBackoff           time.Duration
+	retryMaxBackoff        time.Duration
+	maxIdleConns           int
+	maxIdleConnsPerHost    int
+	idleConnTimeout        time.Duration
+	agentFailures          int
+	agentCooldown          time.Duration
+	fallbackAddress        string
+	fallbackAfter          int
+	kvPrefix               string
 }
 
 var config consulConfig
@@ -31,6 +45,19 @@ func AddCmdFlags(f *flag.FlagSet) {
 	f.StringVar(&config.sslCaCert, "consul-ssl-cacert", "", "")
 	f.StringVar(&config.token, "consul-token", "", "")
 	f.IntVar(&config.heartbeatsBeforeRemove, "heartbeats-before-remove", 1, "")
+	f.IntVar(&config.workers, "consul-workers", 8, "")
+	f.Float64Var(&config.agentRate, "consul-agent-rate", 0, "")
+	f.DurationVar(&config.timeout, "consul-timeout", 10*time.Second, "")
+	f.DurationVar(&config.retryBackoff, "consul-retry-backoff", time.Second, "")
+	f.DurationVar(&config.retryMaxBackoff, "consul-retry-max-backoff", 5*time.Minute, "")
+	f.IntVar(&config.maxIdleConns, "consul-max-idle-conns", 100, "")
+	f.IntVar(&config.maxIdleConnsPerHost, "consul-max-idle-conns-per-host", 2, "")
+	f.DurationVar(&config.idleConnTimeout, "consul-idle-conn-timeout", 90*time.Second, "")
+	f.IntVar(&config.agentFailures, "consul-agent-failures", 3, "")
+	f.DurationVar(&config.agentCooldown, "consul-agent-cooldown", time.Minute, "")
+	f.StringVar(&config.fallbackAddress, "consul-fallback", "", "")
+	f.IntVar(&config.fallbackAfter, "consul-fallback-after", 3, "")
+	f.StringVar(&config.kvPrefix, "consul-kv-prefix", "mesos-consul", "")
 }
 
 func Help() string {
@@ -59,6 +86,47 @@ Consul Options:
   --heartbeats-before-remove	Number of times that registration needs to fail
 				before removing task from Consul
 				(default: 1)
+  --consul-workers		Maximum number of Consul agents registered with
+				concurrently
+				(default: 8)
+  --consul-agent-rate		Maximum number of registration requests per second
+				sent to a single Consul agent. 0 means unlimited
+				(default: 0)
+  --consul-timeout		Timeout of a single request to a Consul agent
+				(default: 10s)
+  --consul-retry-backoff	Delay before retrying a failed registration. The
+				delay doubles after every failed attempt
+				(default: 1s)
+  --consul-retry-max-backoff	Maximum delay between two attempts to register
+				a service
+				(default: 5m)
+  --consul-max-idle-conns	Maximum number of idle connections kept open to
+				all the Consul agents
+				(default: 100)
+  --consul-max-idle-conns-per-host
+				Maximum number of idle connections kept open to
+				a single Consul agent
+				(default: 2)
+  --consul-idle-conn-timeout	Time after which an idle connection to a Consul
+				agent is closed
+				(default: 90s)
+  --consul-agent-failures	Number of consecutive failed requests after which
+				a Consul agent is considered down
+				(default: 3)
+  --consul-agent-cooldown	Time during which requests to a Consul agent
+				considered down are skipped
+				(default: 1m)
+  --consul-fallback		Address (host:port) of a central Consul used to
+				register the services whose local agent is unavailable
+				(default: not set)
+  --consul-fallback-after	Number of failed registrations of a service before
+				it is registered through the central Consul
+				(default: 3)
+  --consul-kv-prefix		Prefix of the keys read by mesos-consul. A service
+				is put into maintenance mode, with the value of the
+				key as reason, while <prefix>/maintenance/<service-id>
+				exists
+				(default: mesos-consul)
 
 `
 
@@ -1,10 +1,13 @@
 package consul
 
 import (
-	"crypto/tls"
+	"expvar"
 	"fmt"
+	"net"
 	"net/http"
+	"reflect"
 	"strings"
+	"sync"
 
 	"github.com/mesos-utility/mesos-consul/registry"
 
@@ -13,16 +16,56 @@ import (
 )
 
 type Consul struct {
-	agents map[string]*consulapi.Client
-	config consulConfig
+	agents     map[string]*agent
+	lock       sync.Mutex
+	httpClient *http.Client
+	config     consulConfig
+	pipeline   *pipeline
+	retries    *retryQueue
+
+	// Central Consul used when the local agent of a service is unavailable
+	central *consulapi.Client
+
+	// Consul agent addresses by Mesos IP and Consul node name
+	agentKeys map[string]string
+
+	// Consul agents put in maintenance by mesos-consul, with the reason
+	nodeMaintenance map[string]string
+	maintenanceLock sync.Mutex
+
+	// syncLock keeps the retries from being queued while Deregister()
+	// runs
+	syncLock sync.Mutex
 }
 
 //
 func New() *Consul {
-	return &Consul{
-		agents: make(map[string]*consulapi.Client),
-		config: config,
+	c := &Consul{
+		agents:          make(map[string]*agent),
+		config:          config,
+		nodeMaintenance: make(map[string]string),
 	}
+	c.httpClient = &http.Client{
+		Transport: newTransport(c.config),
+		Timeout:   c.config.timeout,
+	}
+	c.pipeline = newPipeline(c.config.workers, c.config.agentRate)
+	c.retries = newRetryQueue(c.config.retryBackoff, c.config.retryMaxBackoff)
+	stats.Set("retry_queue", expvar.Func(func() interface{} {
+		return c.retries.depth()
+	}))
+	stats.Set("agents_down", expvar.Func(func() interface{} {
+		return c.agentsDown()
+	}))
+
+	if c.config.fallbackAddress != "" {
+		log.Infof("Using %s as central Consul fallback", c.config.fallbackAddress)
+		c.central = c.newAgent(c.config.fallbackAddress)
+	}
+
+	go c.retryLoop()
+
+	return c
 }
 
 // client()
@@ -33,12 +76,15 @@ func (c *Consul) client(address string) *consulapi.Client {
 		return nil
 	}
 
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	if _, ok := c.agents[address]; !ok {
 		// Agent connection not saved. Connect.
-		c.agents[address] = c.newAgent(address)
+		c.agents[address] = &agent{client: c.newAgent(address)}
 	}
 
-	return c.agents[address]
+	return c.agents[address].client
 }
 
 // newAgent()
@@ -52,9 +98,14 @@ func (c *Consul) newAgent(address string) *consulapi.Client {
 
 	config := consulapi.DefaultConfig()
 
-	config.Address = fmt.Sprintf("%s:%s", address, c.config.port)
+	config.Address = address
+	if _, _, err := net.SplitHostPort(address); err != nil && !strings.HasPrefix(address, "unix://") {
+		config.Address = fmt.Sprintf("%s:%s", address, c.config.port)
+	}
 	log.Debugf("consul address: %s", config.Address)
 
+	config.HttpClient = c.httpClient
+
 	if c.config.token != "" {
 		log.Debugf("setting token to %s", c.config.token)
 		config.Token = c.config.token
@@ -65,15 +116,6 @@ func (c *Consul) newAgent(address string) *consulapi.Client {
 		config.Scheme = "https"
 	}
 
-	if !c.config.sslVerify {
-		log.Debugf("disabled SSL verification")
-		config.HttpClient.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-		}
-	}
-
 	if c.config.auth.Enabled {
 		log.Debugf("setting basic auth")
 		config.HttpAuth = &consulapi.HttpBasicAuth{
@@ -89,20 +131,55 @@ func (c *Consul) newAgent(address string) *consulapi.Client {
 	return client
 }
 
+// Register()
+//   Queue the service for registration on its agent. Registrations are
+//   done concurrently and are all complete once Deregister() runs.
+//
 func (c *Consul) Register(service *registry.Service) {
-	if _, ok := serviceCache[service.ID]; ok {
-		log.Debugf("Service found. Not registering: %s", service.ID)
+	c.pipeline.push(service.Agent, func() { c.register(service) })
+}
+
+func (c *Consul) register(service *registry.Service) {
+	s := registration(service)
+
+	if e, ok := cacheGet(service.ID); ok {
 		c.CacheMark(service.ID)
+		e.health = service.Health
+
+		if sameRegistration(e.service, s) {
+			log.Debugf("Service found. Not registering: %s", service.ID)
+			return
+		}
+
+		log.Info("Registration changed. Re-registering ", service.ID)
+		c.update(e, s, service.Host)
 		return
 	}
 
-	if _, ok := c.agents[service.Agent]; !ok {
-		// Agent connection not saved. Connect.
-		c.agents[service.Agent] = c.newAgent(service.Agent)
+	log.Info("Registering ", service.ID)
+
+	// The entry is cached before it's registered so that the retry queue
+	// and Deregister() know about it whatever the outcome
+	e := newCacheEntry(s, service.Agent, service.Host)
+	e.health = service.Health
+	cachePut(s.ID, e)
+
+	if err := c.syncEntry(e); err != nil {
+		log.Warnf(err.Error())
+		c.fallback(e, c.retries.failed(s.ID))
+		return
 	}
 
-	log.Info("Registering ", service.ID)
+	// Don't leave a new TTL check critical until the end of the sync
+	if e.health != "" {
+		c.updateTTL(e)
+	}
+}
 
+// registration()
+//   Build the Consul registration of the service
+//
+func registration(service *registry.Service) *consulapi.AgentServiceRegistration {
 	s := &consulapi.AgentServiceRegistration{
 		ID:      service.ID,
 		Name:    service.Name,
@@ -112,36 +189,151 @@ func (c *Consul) Register(service *registry.Service) {
 			TTL:      service.Check.TTL,
 			Script:   service.Check.Script,
 			HTTP:     service.Check.HTTP,
+			TCP:      service.Check.TCP,
 			Interval: service.Check.Interval,
+			Timeout:  service.Check.Timeout,
 		},
 	}
 
 	if len(service.Tags) > 0 {
 		s.Tags = service.Tags
 	}
+	if len(service.Meta) > 0 {
+		s.Meta = service.Meta
+	}
 
-	err := c.agents[service.Agent].Agent().ServiceRegister(s)
-	if err != nil {
-		log.Warnf("Unable to register %s: %s", s.ID, err.Error())
-		return
+	return s
+}
+
+// sameRegistration()
+//   Compare a cached registration with a new one. The check of the
+//   registrations loaded from the catalog isn't known: they are
+//   registered again once when they should have a check.
+//
+func sameRegistration(a, b *consulapi.AgentServiceRegistration) bool {
+	if a.Name != b.Name || a.Port != b.Port || a.Address != b.Address {
+		return false
+	}
+	if !sliceEq(a.Tags, b.Tags) || !reflect.DeepEqual(mapOrNil(a.Meta), mapOrNil(b.Meta)) {
+		return false
+	}
+
+	return reflect.DeepEqual(checkOrNil(a.Check), checkOrNil(b.Check))
+}
+
+func checkOrNil(c *consulapi.AgentServiceCheck) *consulapi.AgentServiceCheck {
+	if c == nil || reflect.DeepEqual(*c, consulapi.AgentServiceCheck{}) {
+		return nil
+	}
+
+	return c
+}
+
+func sliceEq(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
 	}
 
-	if err, ret := c.registerUpstream(service); !ret {
+	return true
+}
+
+func mapOrNil(m map[string]string) map[string]string {
+	if len(m) == 0 {
+		return nil
+	}
+
+	return m
+}
+
+// update()
+//   Replace the registration of a cached service
+//
+func (c *Consul) update(e *cacheEntry, s *consulapi.AgentServiceRegistration, host string) {
+	// The nginx upstream key depends on the name, host and port
+	if e.upstream && upstreamKey(e) != upstreamKey(&cacheEntry{service: s, agent: e.agent, host: host}) {
+		if err, _ := c.deRegisterUpstream(e, c.upstreamClient(e.agent)); err != nil {
+			log.Warnf(err.Error())
+		}
+		e.upstream = false
+	}
+
+	cacheLock.Lock()
+	e.service = s
+	e.host = host
+	e.registered = false
+	cacheLock.Unlock()
+
+	if err := c.syncEntry(e); err != nil {
 		log.Warnf(err.Error())
-		return
+		c.fallback(e, c.retries.failed(s.ID))
+	}
+}
+
+// syncEntry()
+//   Run the registration steps of the entry that didn't succeed yet
+//
+func (c *Consul) syncEntry(e *cacheEntry) error {
+	if c.agentDown(e.agent) {
+		return errAgentDown(e.agent)
 	}
 
-	serviceCache[s.ID] = newCacheEntry(s, service.Agent)
-	c.CacheMark(s.ID)
+	if !e.registered {
+		err := c.client(e.agent).Agent().ServiceRegister(e.service)
+		c.agentResult(e.agent, err)
+		if err != nil {
+			return fmt.Errorf("Unable to register %s: %s", e.service.ID, err.Error())
+		}
+		e.registered = true
+	}
+
+	if e.external {
+		if err := c.deregisterExternal(e); err != nil {
+			return fmt.Errorf("Unable to remove the fallback registration of %s: %s", e.service.ID, err.Error())
+		}
+		log.Infof("Moved %s back to Consul agent %s", e.service.ID, e.agent)
+		stats.Add("fallback_migrations", 1)
+		e.external = false
+	}
+
+	if !e.upstream {
+		err, ret := c.registerUpstream(e, c.client(e.agent))
+		c.agentResult(e.agent, err)
+		if !ret {
+			return err
+		}
+		e.upstream = true
+	}
+
+	return nil
+}
+
+// upstreamKey()
+//   Key of the nginx upstream of the service, named after the Mesos
+//   agent IP
+//
+func upstreamKey(entry *cacheEntry) string {
+	host := entry.host
+	if host == "" {
+		host = entry.agent
+	}
+
+	return fmt.Sprintf("upstreams/%s/%s:%d", entry.service.Name, host, entry.service.Port)
 }
 
-func (c *Consul) registerUpstream(service *registry.Service) (error, bool) {
+func (c *Consul) registerUpstream(entry *cacheEntry, client *consulapi.Client) (error, bool) {
 	// XXX: register nginx upstream in k/v value.
-	var hkey = fmt.Sprintf("upstreams/%s/%s:%d", service.Name, service.Agent, service.Port)
+	var hkey = upstreamKey(entry)
 	value := []byte("{\"weight\":1, \"max_fails\":2, \"fail_timeout\":10}")
 	p := &consulapi.KVPair{Key: hkey, Value: value}
 
-	if work, _, e := c.agents[service.Agent].KV().CAS(p, nil); e != nil {
+	work, _, e := client.KV().CAS(p, nil)
+	if e != nil {
 		err := fmt.Errorf("Unable to CAS key %s: %s", hkey, e.Error())
 		return err, false
 	} else if !work {
@@ -151,20 +343,13 @@ func (c *Consul) registerUpstream(service *registry.Service) (error, bool) {
 	return nil, true
 }
 
-func (c *Consul) deRegisterUpstream(service *consulapi.AgentServiceRegistration) (error, bool) {
+func (c *Consul) deRegisterUpstream(entry *cacheEntry, client *consulapi.Client) (error, bool) {
 	// XXX: deregister nginx upstream in k/v value.
-	var agents = strings.Split(service.ID, ":")
-	var agent = agents[1]
-	if strings.Contains(agent, "-") {
-		agent = strings.Split(agent, "-")[0]
-	}
-	var hkey = fmt.Sprintf("upstreams/%s/%s:%d", service.Name, agent, service.Port)
+	var hkey = upstreamKey(entry)
 
-	if _, ok := c.agents[agent]; ok {
-		if _, e := c.agents[agent].KV().Delete(hkey, nil); e != nil {
-			err := fmt.Errorf("Unable to Delete key %s: %s", hkey, e.Error())
-			return err, false
-		}
+	if _, e := client.KV().Delete(hkey, nil); e != nil {
+		err := fmt.Errorf("Unable to Delete key %s: %s", hkey, e.Error())
+		return err, false
 	}
 	return nil, true
 }
@@ -173,30 +358,136 @@ func (c *Consul) deRegisterUpstream(service *consulapi.AgentServiceRegistration)
 //   Deregister services that no longer exist
 //
 func (c *Consul) Deregister() {
-	for s, b := range serviceCache {
+	c.syncLock.Lock()
+	defer c.syncLock.Unlock()
+
+	// Wait for the queued registrations to mark their services
+	c.pipeline.wait()
+
+	for s, b := range cacheEntries() {
 		if c.CacheIsValid(s) {
 			c.CacheProcessDeregister(s)
-		} else {
-			log.Infof("Deregistering %s", s)
-			err := c.deregister(b.agent, b.service)
-			if err != nil {
-				log.Info("Deregistration error ", err)
-			} else {
-				if err, _ := c.deRegisterUpstream(b.service); err != nil {
-					log.Warnf(err.Error())
-				}
-				delete(serviceCache, s)
-			}
+			continue
+		}
+
+		c.remove(s, b)
+	}
+
+	c.updateTTLs()
+
+	c.evictAgents()
+}
+
+// DeregisterIDs()
+//   Deregister the services right away, without waiting for them to be
+//   missing from the next syncs
+//
+func (c *Consul) DeregisterIDs(ids []string) {
+	c.syncLock.Lock()
+	defer c.syncLock.Unlock()
+
+	c.pipeline.wait()
+
+	for _, id := range ids {
+		if e, ok := cacheGet(id); ok {
+			c.remove(id, e)
+		}
+	}
+}
 
+// remove()
+//   Deregister the service from everywhere it was registered and drop it
+//   from the cache. The entry is kept for the next attempt on error.
+//
+func (c *Consul) remove(id string, e *cacheEntry) {
+	log.Infof("Deregistering %s", id)
+	if e.registered {
+		err := c.deregister(e.agent, e.service)
+		if err != nil {
+			log.Info("Deregistration error ", err)
+			return
+		}
+	}
+	if e.external {
+		if err := c.deregisterExternal(e); err != nil {
+			log.Info("Deregistration error ", err)
+			return
 		}
 	}
+	if e.upstream {
+		if err, _ := c.deRegisterUpstream(e, c.upstreamClient(e.agent)); err != nil {
+			log.Warnf(err.Error())
+		}
+	}
+	c.CacheDelete(id)
+	c.retries.remove(id)
 }
 
 func (c *Consul) deregister(agent string, service *consulapi.AgentServiceRegistration) error {
-	if _, ok := c.agents[agent]; !ok {
-		// Agent connection not saved. Connect.
-		c.agents[agent] = c.newAgent(agent)
+	if c.agentDown(agent) {
+		return errAgentDown(agent)
+	}
+
+	err := c.client(agent).Agent().ServiceDeregister(service.ID)
+	c.agentResult(agent, err)
+
+	return err
+}
+
+// SetAgents()
+//   Record the Consul agent of every Mesos agent, so that the services
+//   found in the catalog are attached to the same agent they're
+//   registered on
+//
+func (c *Consul) SetAgents(agents []*registry.Agent) {
+	keys := make(map[string]string)
+	for _, a := range agents {
+		keys[a.IP] = a.Address
+		if a.Node != "" {
+			keys[a.Node] = a.Address
+		}
+		keys[fallbackNode(a.Address)] = a.Address
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.agentKeys = keys
+}
+
+// agentKey()
+//   Return the Consul agent of a catalog node
+//
+func (c *Consul) agentKey(node string, address string) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if a, ok := c.agentKeys[node]; ok {
+		return a
+	}
+	if a, ok := c.agentKeys[address]; ok {
+		return a
+	}
+
+	return address
+}
+
+// CatalogNodes()
+//   List the nodes of the Consul catalog
+//
+func (c *Consul) CatalogNodes(host string) ([]*registry.Agent, error) {
+	nodes, _, err := c.client(host).Catalog().Nodes(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	agents := make([]*registry.Agent, len(nodes))
+	for i, n := range nodes {
+		agents[i] = &registry.Agent{
+			Node:    n.Node,
+			Address: n.Address,
+		}
 	}
 
-	return c.agents[agent].Agent().ServiceDeregister(service.ID)
+	return agents, nil
 }
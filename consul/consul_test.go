@@ -0,0 +1,26 @@
+package consul
+
+import (
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func TestSameRegistration_Check(t *testing.T) {
+	loaded := &consulapi.AgentServiceRegistration{ID: "web", Name: "web", Port: 31000}
+	ttl := &consulapi.AgentServiceRegistration{ID: "web", Name: "web", Port: 31000, Check: &consulapi.AgentServiceCheck{TTL: "3m"}}
+	none := &consulapi.AgentServiceRegistration{ID: "web", Name: "web", Port: 31000, Check: &consulapi.AgentServiceCheck{}}
+
+	if sameRegistration(loaded, ttl) {
+		t.Error("a registration loaded from the catalog should get its check")
+	}
+	if !sameRegistration(loaded, none) {
+		t.Error("a registration without check shouldn't be registered again")
+	}
+	if !sameRegistration(ttl, &consulapi.AgentServiceRegistration{ID: "web", Name: "web", Port: 31000, Check: &consulapi.AgentServiceCheck{TTL: "3m"}}) {
+		t.Error("identical checks should match")
+	}
+	if sameRegistration(ttl, &consulapi.AgentServiceRegistration{ID: "web", Name: "web", Port: 31000, Check: &consulapi.AgentServiceCheck{HTTP: "http://h/"}}) {
+		t.Error("a changed check should be registered again")
+	}
+}
@@ -0,0 +1,101 @@
+package consul
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+
+	consulapi "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Services whose local agent keeps refusing them are registered through the
+// central Consul as services of an external node named after the agent.
+// They move back to the local agent as soon as it accepts them again, and
+// the external copy is removed so the service isn't listed twice.
+
+const fallbackNodePrefix = "mesos-consul-"
+
+var nodeNameRegex = regexp.MustCompile("[^A-Za-z0-9-]")
+
+// fallbackNode()
+//   Name of the external node holding the fallback registrations of the
+//   agent
+//
+func fallbackNode(agent string) string {
+	return fallbackNodePrefix + nodeNameRegex.ReplaceAllString(agent, "-")
+}
+
+// fallback()
+//   Register the entry through the central Consul once its registration
+//   failed often enough
+//
+func (c *Consul) fallback(e *cacheEntry, attempts int) {
+	if c.central == nil || e.registered || e.external || attempts < c.config.fallbackAfter {
+		return
+	}
+
+	if err := c.registerExternal(e); err != nil {
+		log.Warnf("Unable to register %s through the central Consul: %s", e.service.ID, err.Error())
+		return
+	}
+
+	log.Infof("Registered %s through the central Consul on node %s", e.service.ID, fallbackNode(e.agent))
+	stats.Add("fallback_registrations", 1)
+	e.external = true
+
+	if !e.upstream {
+		if err, ret := c.registerUpstream(e, c.central); !ret {
+			log.Warnf(err.Error())
+			return
+		}
+		e.upstream = true
+	}
+}
+
+func (c *Consul) registerExternal(e *cacheEntry) error {
+	address, _, err := net.SplitHostPort(e.agent)
+	if err != nil {
+		address = e.agent
+	}
+
+	_, err = c.central.Catalog().Register(&consulapi.CatalogRegistration{
+		Node:    fallbackNode(e.agent),
+		Address: address,
+		Service: &consulapi.AgentService{
+			ID:      e.service.ID,
+			Service: e.service.Name,
+			Tags:    e.service.Tags,
+			Port:    e.service.Port,
+			Address: e.service.Address,
+			Meta:    e.service.Meta,
+		},
+	}, nil)
+
+	return err
+}
+
+func (c *Consul) deregisterExternal(e *cacheEntry) error {
+	if c.central == nil {
+		return fmt.Errorf("no central Consul to remove %s from", e.service.ID)
+	}
+
+	_, err := c.central.Catalog().Deregister(&consulapi.CatalogDeregistration{
+		Node:      fallbackNode(e.agent),
+		ServiceID: e.service.ID,
+	}, nil)
+
+	return err
+}
+
+// upstreamClient()
+//   Return the client used for the upstream keys of the agent. The central
+//   Consul stands in for agents that are down.
+//
+func (c *Consul) upstreamClient(agent string) *consulapi.Client {
+	if c.central != nil && c.agentDown(agent) {
+		return c.central
+	}
+
+	return c.client(agent)
+}
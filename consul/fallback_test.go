@@ -0,0 +1,133 @@
+package consul
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFallback(t *testing.T) {
+	central := newFakeAgent()
+	defer central.Close()
+
+	c := newTestConsul()
+	c.central = c.newAgent(central.address())
+
+	dead := deadAgent(t)
+	e := testEntry(dead)
+
+	// The agent is only bypassed once the registration failed often
+	// enough
+	c.fallback(e, c.config.fallbackAfter-1)
+	if e.external || len(central.received()) != 0 {
+		t.Fatal("fell back before enough failed attempts")
+	}
+
+	for i := 0; i < c.config.agentFailures; i++ {
+		if err := c.syncEntry(e); err == nil {
+			t.Fatal("registered on a dead agent")
+		}
+	}
+	if err := c.syncEntry(e); err == nil || err.Error() != errAgentDown(dead).Error() {
+		t.Errorf("got error %v, want the agent down", err)
+	}
+
+	c.fallback(e, c.config.fallbackAfter)
+	if !e.external || !e.upstream || e.registered {
+		t.Errorf("entry registered %v, external %v, upstream %v: want only external and upstream", e.registered, e.external, e.upstream)
+	}
+
+	want := []string{"PUT /v1/catalog/register", "PUT /v1/kv/" + upstreamKey(e)}
+	if reqs := central.received(); !reflect.DeepEqual(reqs, want) {
+		t.Errorf("central got %v, want %v", reqs, want)
+	}
+
+	// The upstream key of an agent down is kept up to date through the
+	// central Consul
+	if c.upstreamClient(dead) != c.central {
+		t.Error("upstream client of an agent down isn't the central Consul")
+	}
+
+	// Already external, nothing is registered twice
+	c.fallback(e, c.config.fallbackAfter+1)
+	if reqs := central.received(); len(reqs) != len(want) {
+		t.Errorf("central got %v after a second fallback", reqs)
+	}
+}
+
+func TestFallback_MoveBack(t *testing.T) {
+	central := newFakeAgent()
+	defer central.Close()
+	local := newFakeAgent()
+	defer local.Close()
+
+	c := newTestConsul()
+	c.central = c.newAgent(central.address())
+
+	// The agent was down while the service fell back, and recovered
+	c.client(local.address())
+	c.agents[local.address()].failures = c.config.agentFailures
+	c.agents[local.address()].lastFailure = time.Now().Add(-2 * time.Minute)
+
+	e := testEntry(local.address())
+	e.external = true
+	e.upstream = true
+
+	if err := c.syncEntry(e); err != nil {
+		t.Fatalf("got error %v moving back", err)
+	}
+	if !e.registered || e.external {
+		t.Errorf("entry registered %v, external %v: want only registered", e.registered, e.external)
+	}
+
+	if reqs := local.received(); !reflect.DeepEqual(reqs, []string{"PUT /v1/agent/service/register"}) {
+		t.Errorf("local agent got %v, want the registration", reqs)
+	}
+	if reqs := central.received(); !reflect.DeepEqual(reqs, []string{"PUT /v1/catalog/deregister"}) {
+		t.Errorf("central got %v, want the fallback deregistration", reqs)
+	}
+	if c.upstreamClient(local.address()) == c.central {
+		t.Error("upstream client of a recovered agent is the central Consul")
+	}
+}
+
+func TestFallback_MoveBackFailure(t *testing.T) {
+	local := newFakeAgent()
+	defer local.Close()
+
+	c := newTestConsul()
+	c.central = c.newAgent(deadAgent(t))
+
+	e := testEntry(local.address())
+	e.external = true
+	e.upstream = true
+
+	// The local registration is kept, and the external copy removed on
+	// the next attempt
+	if err := c.syncEntry(e); err == nil {
+		t.Fatal("moved back without removing the fallback registration")
+	}
+	if !e.registered || !e.external {
+		t.Errorf("entry registered %v, external %v: want both", e.registered, e.external)
+	}
+
+	c.central = nil
+	if err := c.syncEntry(e); err == nil || !e.external {
+		t.Error("dropped the fallback registration without a central Consul")
+	}
+	if reqs := local.received(); len(reqs) != 1 {
+		t.Errorf("local agent got %v, want a single registration", reqs)
+	}
+}
+
+func TestFallbackNode(t *testing.T) {
+	for agent, want := range map[string]string{
+		"10.0.0.1":                    "mesos-consul-10-0-0-1",
+		"agent1.example.com:8500":     "mesos-consul-agent1-example-com-8500",
+		"unix:///var/run/consul.sock": "mesos-consul-unix----var-run-consul-sock",
+	} {
+		if got := fallbackNode(agent); got != want {
+			t.Errorf("%s: got node %s, want %s", agent, got, want)
+		}
+	}
+}
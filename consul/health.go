@@ -0,0 +1,53 @@
+package consul
+
+import (
+	"github.com/mesos-utility/mesos-consul/registry"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// updateTTLs()
+//   Queue the update of the TTL checks of the services with a Mesos
+//   health. Every service is updated, whether its task changed or not,
+//   so that the checks don't expire.
+//
+func (c *Consul) updateTTLs() {
+	for _, e := range cacheEntries() {
+		if e.health == "" {
+			continue
+		}
+
+		e := e
+		c.pipeline.push(e.agent, func() { c.updateTTL(e) })
+	}
+}
+
+// updateTTL()
+//   Set the status of the TTL check of the service from its Mesos health
+//
+func (c *Consul) updateTTL(e *cacheEntry) {
+	if !e.registered || c.agentDown(e.agent) {
+		return
+	}
+
+	checkID := "service:" + e.service.ID
+	client := c.client(e.agent).Agent()
+
+	var err error
+	switch e.health {
+	case registry.HealthPassing:
+		err = client.PassTTL(checkID, "Task reported healthy by Mesos")
+	case registry.HealthCritical:
+		err = client.FailTTL(checkID, "Task reported unhealthy by Mesos")
+	default:
+		err = client.WarnTTL(checkID, "No health reported by Mesos")
+	}
+	c.agentResult(e.agent, err)
+
+	if err != nil {
+		log.Warnf("Unable to update the TTL check of %s: %s", e.service.ID, err.Error())
+		stats.Add("ttl_failures", 1)
+		return
+	}
+	stats.Add("ttl_updates", 1)
+}
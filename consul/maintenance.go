@@ -0,0 +1,211 @@
+package consul
+
+import (
+	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// The reasons of the maintenances enabled by mesos-consul start with
+// maintenancePrefix, so that the ones enabled by operators are never
+// cleared
+const maintenancePrefix = "mesos-consul: "
+
+const (
+	nodeMaintenanceCheck    = "_node_maintenance"
+	serviceMaintenanceCheck = "_service_maintenance:"
+)
+
+// Maintenance()
+//   Enable the maintenance of the Consul agents and services that have a
+//   reason, and disable the maintenances enabled by mesos-consul that
+//   are over
+//
+func (c *Consul) Maintenance(nodes map[string]string, services map[string]string) {
+	c.maintenanceLock.Lock()
+	current := make(map[string]string, len(c.nodeMaintenance))
+	for agent, reason := range c.nodeMaintenance {
+		current[agent] = reason
+	}
+	c.maintenanceLock.Unlock()
+
+	for agent, reason := range nodes {
+		if _, ok := current[agent]; !ok {
+			agent, reason := agent, reason
+			c.pipeline.push(agent, func() { c.agentMaintenance(agent, reason) })
+		}
+	}
+	for agent := range current {
+		if _, ok := nodes[agent]; !ok {
+			agent := agent
+			c.pipeline.push(agent, func() { c.agentMaintenance(agent, "") })
+		}
+	}
+
+	// Maintenance jobs of the previous run are done, so the entries can
+	// be read safely
+	for id, e := range cacheEntries() {
+		reason := services[id]
+		if (reason == "") == (e.maintenance == "") {
+			continue
+		}
+
+		e := e
+		c.pipeline.push(e.agent, func() { c.serviceMaintenance(e, reason) })
+	}
+}
+
+// agentMaintenance()
+//   Enable the maintenance of the agent, or disable it when there's no
+//   reason
+//
+func (c *Consul) agentMaintenance(agent string, reason string) {
+	if c.agentDown(agent) {
+		return
+	}
+
+	client := c.client(agent).Agent()
+
+	var err error
+	if reason != "" {
+		if owner, ok := c.maintenanceOwner(client, nodeMaintenanceCheck); ok && !owner {
+			log.Infof("Consul agent %s already in maintenance. Leaving it alone", agent)
+			return
+		}
+
+		log.Infof("Enabling maintenance of Consul agent %s: %s", agent, reason)
+		err = client.EnableNodeMaintenance(maintenancePrefix + reason)
+	} else {
+		log.Infof("Disabling maintenance of Consul agent %s", agent)
+		err = client.DisableNodeMaintenance()
+	}
+	c.agentResult(agent, err)
+	if err != nil {
+		log.Warnf("Unable to update the maintenance of Consul agent %s: %s", agent, err.Error())
+		return
+	}
+
+	c.maintenanceLock.Lock()
+	defer c.maintenanceLock.Unlock()
+
+	if reason != "" {
+		c.nodeMaintenance[agent] = reason
+	} else {
+		delete(c.nodeMaintenance, agent)
+	}
+}
+
+// serviceMaintenance()
+//   Enable the maintenance of the service, or disable it when there's no
+//   reason
+//
+func (c *Consul) serviceMaintenance(e *cacheEntry, reason string) {
+	if !e.registered || c.agentDown(e.agent) {
+		return
+	}
+
+	client := c.client(e.agent).Agent()
+
+	var err error
+	if reason != "" {
+		if owner, ok := c.maintenanceOwner(client, serviceMaintenanceCheck+e.service.ID); ok && !owner {
+			log.Infof("%s already in maintenance. Leaving it alone", e.service.ID)
+			return
+		}
+
+		log.Infof("Enabling maintenance of %s: %s", e.service.ID, reason)
+		err = client.EnableServiceMaintenance(e.service.ID, maintenancePrefix+reason)
+	} else {
+		log.Infof("Disabling maintenance of %s", e.service.ID)
+		err = client.DisableServiceMaintenance(e.service.ID)
+	}
+	c.agentResult(e.agent, err)
+	if err != nil {
+		log.Warnf("Unable to update the maintenance of %s: %s", e.service.ID, err.Error())
+		return
+	}
+
+	e.maintenance = reason
+}
+
+// maintenanceOwner()
+//   Look for the maintenance check on the agent and tell whether
+//   mesos-consul enabled it
+//
+func (c *Consul) maintenanceOwner(client *consulapi.Agent, checkID string) (owner bool, found bool) {
+	checks, err := client.Checks()
+	if err != nil {
+		return false, false
+	}
+
+	check, ok := checks[checkID]
+	if !ok {
+		return false, false
+	}
+
+	return strings.HasPrefix(check.Notes, maintenancePrefix), true
+}
+
+// loadMaintenance()
+//   Find the maintenances enabled by a previous run of mesos-consul, so
+//   that they're cleared when they're over
+//
+func (c *Consul) loadMaintenance(host string, nodes map[string]string) error {
+	checks, _, err := c.client(host).Health().State("any", nil)
+	if err != nil {
+		return err
+	}
+
+	c.maintenanceLock.Lock()
+	defer c.maintenanceLock.Unlock()
+
+	for _, check := range checks {
+		if !strings.HasPrefix(check.Notes, maintenancePrefix) {
+			continue
+		}
+		reason := strings.TrimPrefix(check.Notes, maintenancePrefix)
+
+		switch {
+		case check.CheckID == nodeMaintenanceCheck:
+			if address, ok := nodes[check.Node]; ok {
+				c.nodeMaintenance[c.agentKey(check.Node, address)] = reason
+			}
+		case strings.HasPrefix(check.CheckID, serviceMaintenanceCheck):
+			if e, ok := cacheGet(strings.TrimPrefix(check.CheckID, serviceMaintenanceCheck)); ok {
+				e.maintenance = reason
+			}
+		}
+	}
+
+	return nil
+}
+
+// MaintenanceKeys()
+//   Return the maintenance reasons of the services that have a key under
+//   <prefix>/maintenance/
+//
+func (c *Consul) MaintenanceKeys(host string) (map[string]string, error) {
+	prefix := c.config.kvPrefix + "/maintenance/"
+
+	pairs, _, err := c.client(host).KV().List(prefix, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	reasons := make(map[string]string)
+	for _, p := range pairs {
+		id := strings.TrimPrefix(p.Key, prefix)
+		if id == "" {
+			continue
+		}
+
+		reason := string(p.Value)
+		if reason == "" {
+			reason = "Maintenance requested in Consul KV"
+		}
+		reasons[id] = reason
+	}
+
+	return reasons, nil
+}
@@ -0,0 +1,122 @@
+package consul
+
+import (
+	"sync"
+	"time"
+)
+
+// The registration pipeline queues jobs by Consul agent. Each agent queue
+// is drained by its own worker, so a slow agent only delays the services
+// registered on it. The number of agents talked to at the same time is
+// bounded by the number of slots.
+type pipeline struct {
+	sync.Mutex
+
+	queues   map[string]*agentQueue
+	slots    chan struct{}
+	interval time.Duration
+	pending  sync.WaitGroup
+
+	// Time of the last job of the agents whose queue drained, so the
+	// rate limit holds across syncs
+	last map[string]time.Time
+}
+
+type agentQueue struct {
+	jobs []func()
+	last time.Time
+}
+
+func newPipeline(workers int, rate float64) *pipeline {
+	if workers < 1 {
+		workers = 1
+	}
+
+	p := &pipeline{
+		queues: make(map[string]*agentQueue),
+		slots:  make(chan struct{}, workers),
+		last:   make(map[string]time.Time),
+	}
+
+	if rate > 0 {
+		p.interval = time.Duration(float64(time.Second) / rate)
+	}
+
+	return p
+}
+
+// push()
+//   Queue the job on the agent and start a worker for the agent if
+//   there's none running
+//
+func (p *pipeline) push(agent string, job func()) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.pending.Add(1)
+
+	if q, ok := p.queues[agent]; ok {
+		q.jobs = append(q.jobs, job)
+		return
+	}
+
+	q := &agentQueue{jobs: []func(){job}, last: p.last[agent]}
+	delete(p.last, agent)
+	p.queues[agent] = q
+	go p.run(agent, q)
+}
+
+func (p *pipeline) run(agent string, q *agentQueue) {
+	for {
+		p.Lock()
+		if len(q.jobs) == 0 {
+			delete(p.queues, agent)
+			p.drained(agent, q.last)
+			p.Unlock()
+			return
+		}
+		job := q.jobs[0]
+		q.jobs = q.jobs[1:]
+		p.Unlock()
+
+		if p.interval > 0 {
+			if wait := q.last.Add(p.interval).Sub(time.Now()); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+
+		p.slots <- struct{}{}
+		q.last = time.Now()
+		job()
+		<-p.slots
+
+		p.pending.Done()
+	}
+}
+
+// drained()
+//   Keep the time of the last job of the agent for its next queue, and
+//   forget the agents whose rate limit has expired
+//
+func (p *pipeline) drained(agent string, last time.Time) {
+	if p.interval == 0 {
+		return
+	}
+
+	now := time.Now()
+	for a, t := range p.last {
+		if now.Sub(t) >= p.interval {
+			delete(p.last, a)
+		}
+	}
+	if now.Sub(last) < p.interval {
+		p.last[agent] = last
+	}
+}
+
+// wait()
+//   Block until every queued job has been processed
+//
+func (p *pipeline) wait() {
+	p.pending.Wait()
+}
@@ -0,0 +1,74 @@
+package consul
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPipeline(t *testing.T) {
+	var lock sync.Mutex
+	done := make(map[string][]string)
+
+	p := newPipeline(2, 0)
+
+	for i := 0; i < 10; i++ {
+		for _, agent := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+			agent, id := agent, fmt.Sprintf("%s:%d", agent, i)
+			p.push(agent, func() {
+				lock.Lock()
+				defer lock.Unlock()
+				done[agent] = append(done[agent], id)
+			})
+		}
+	}
+	p.wait()
+
+	for agent, ids := range done {
+		if len(ids) != 10 {
+			t.Fatalf("%s: got %d registrations, want 10", agent, len(ids))
+		}
+		for i, id := range ids {
+			if want := fmt.Sprintf("%s:%d", agent, i); id != want {
+				t.Errorf("%s: registration #%d is %s, want %s", agent, i, id, want)
+			}
+		}
+	}
+	if len(done) != 3 {
+		t.Errorf("got registrations for %d agents, want 3", len(done))
+	}
+}
+
+func TestPipeline_RateAcrossSyncs(t *testing.T) {
+	var lock sync.Mutex
+	var runs []time.Time
+
+	p := newPipeline(2, 10)
+	job := func() {
+		lock.Lock()
+		defer lock.Unlock()
+		runs = append(runs, time.Now())
+	}
+
+	// Every sync drains the queue of the agent before the next one
+	for i := 0; i < 3; i++ {
+		p.push("10.0.0.1", job)
+		p.wait()
+	}
+
+	for i := 1; i < len(runs); i++ {
+		if d := runs[i].Sub(runs[i-1]); d < p.interval-10*time.Millisecond {
+			t.Errorf("job #%d ran %v after the previous one, want at least %v", i, d, p.interval)
+		}
+	}
+
+	time.Sleep(p.interval)
+	p.Lock()
+	p.drained("10.0.0.2", time.Now())
+	_, stale := p.last["10.0.0.1"]
+	p.Unlock()
+	if stale {
+		t.Error("kept the last job of an agent past the interval")
+	}
+}
@@ -0,0 +1,145 @@
+package consul
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Registration counters, published on /debug/vars of the healthcheck endpoint
+var stats = expvar.NewMap("consul")
+
+// The retry queue holds the IDs of the cached services whose registration
+// steps didn't all succeed. Every service is retried with its own
+// exponential backoff until it's registered or removed from the cache.
+type retryQueue struct {
+	sync.Mutex
+
+	items      map[string]*retryItem
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+type retryItem struct {
+	attempts int
+	next     time.Time
+	inFlight bool
+}
+
+func newRetryQueue(backoff, maxBackoff time.Duration) *retryQueue {
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	if maxBackoff < backoff {
+		maxBackoff = backoff
+	}
+
+	return &retryQueue{
+		items:      make(map[string]*retryItem),
+		backoff:    backoff,
+		maxBackoff: maxBackoff,
+	}
+}
+
+// failed()
+//   Schedule the next attempt of the service ID and return the number of
+//   failed attempts so far
+//
+func (q *retryQueue) failed(id string) int {
+	q.Lock()
+	defer q.Unlock()
+
+	item, ok := q.items[id]
+	if !ok {
+		item = &retryItem{}
+		q.items[id] = item
+	}
+
+	delay := q.backoff
+	for i := 0; i < item.attempts && delay < q.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > q.maxBackoff {
+		delay = q.maxBackoff
+	}
+
+	item.attempts++
+	item.next = time.Now().Add(delay)
+	item.inFlight = false
+
+	return item.attempts
+}
+
+// due()
+//   Return the service IDs whose next attempt is due. They are not
+//   returned again until failed() or remove() is called for them.
+//
+func (q *retryQueue) due(now time.Time) []string {
+	q.Lock()
+	defer q.Unlock()
+
+	var ids []string
+	for id, item := range q.items {
+		if !item.inFlight && !now.Before(item.next) {
+			item.inFlight = true
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+func (q *retryQueue) remove(id string) {
+	q.Lock()
+	defer q.Unlock()
+
+	delete(q.items, id)
+}
+
+func (q *retryQueue) depth() int {
+	q.Lock()
+	defer q.Unlock()
+
+	return len(q.items)
+}
+
+// retryLoop()
+//   Queue the due retries on the registration pipeline
+//
+func (c *Consul) retryLoop() {
+	for range time.Tick(time.Second) {
+		c.syncLock.Lock()
+		for _, id := range c.retries.due(time.Now()) {
+			e, ok := cacheGet(id)
+			if !ok {
+				c.retries.remove(id)
+				continue
+			}
+
+			id := id
+			c.pipeline.push(e.agent, func() { c.retry(id) })
+		}
+		c.syncLock.Unlock()
+	}
+}
+
+func (c *Consul) retry(id string) {
+	e, ok := cacheGet(id)
+	if !ok {
+		c.retries.remove(id)
+		return
+	}
+
+	stats.Add("retries", 1)
+	if err := c.syncEntry(e); err != nil {
+		log.Warnf("Retry failed: %s", err.Error())
+		stats.Add("retry_failures", 1)
+		c.fallback(e, c.retries.failed(id))
+		return
+	}
+
+	log.Infof("Registered %s after retry", id)
+	c.retries.remove(id)
+}
@@ -0,0 +1,34 @@
+package consul
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryQueue(t *testing.T) {
+	q := newRetryQueue(time.Second, 4*time.Second)
+	now := time.Now()
+
+	for i, want := range []time.Duration{1, 2, 4, 4} {
+		q.failed("a")
+		next := q.items["a"].next
+		if got := next.Sub(now); got < want*time.Second || got > want*time.Second+time.Second {
+			t.Errorf("attempt #%d: got delay %v, want %v", i, got, want*time.Second)
+		}
+	}
+
+	if ids := q.due(now); len(ids) != 0 {
+		t.Errorf("got due %v before the delay", ids)
+	}
+	if ids := q.due(now.Add(time.Minute)); len(ids) != 1 || ids[0] != "a" {
+		t.Errorf("got due %v, want [a]", ids)
+	}
+	if ids := q.due(now.Add(time.Minute)); len(ids) != 0 {
+		t.Errorf("got in-flight %v due again", ids)
+	}
+
+	q.remove("a")
+	if d := q.depth(); d != 0 {
+		t.Errorf("got depth %d after remove, want 0", d)
+	}
+}
@@ -31,10 +31,17 @@ func main() {
 	log.Info("Using zookeeper: ", c.Zk)
 	leader := mesos.New(c)
 
+	// The periodic refresh stays the reference, the Marathon events only
+	// bring the changes forward
 	ticker := time.NewTicker(c.Refresh)
 	leader.Refresh()
-	for _ = range ticker.C {
-		leader.Refresh()
+	for {
+		select {
+		case <-ticker.C:
+			leader.Refresh()
+		case apps := <-leader.Triggers():
+			leader.SyncApps(apps)
+		}
 	}
 }
 
@@ -59,11 +66,33 @@ func parseFlags(args []string) (*config.Config, error) {
 
 	flags.BoolVar(&doHelp, "help", false, "")
 	flags.BoolVar(&doVersion, "version", false, "")
+	flags.StringVar(&c.ConfigFile, "config", "", "")
 	flags.StringVar(&c.LogLevel, "log-level", "WARN", "")
 	flags.DurationVar(&c.Refresh, "refresh", time.Minute, "")
 	flags.StringVar(&c.Zk, "zk", "zk://127.0.0.1:2181/mesos", "")
 	flags.StringVar(&c.Separator, "group-separator", "", "")
+	flags.StringVar(&c.NameCollisions, "name-collisions", "warn", "")
+	flags.StringVar(&c.NameReplacement, "name-replacement", "-", "")
+	flags.IntVar(&c.NameMaxLength, "name-max-length", 0, "")
+	flags.BoolVar(&c.NameTrim, "name-trim", false, "")
+	flags.BoolVar(&c.NameStrict, "name-strict", false, "")
 	flags.StringVar(&c.MesosIpOrder, "mesos-ip-order", "netinfo,mesos,host", "")
+	flags.StringVar(&c.StateMode, "state-mode", "master", "")
+	flags.IntVar(&c.AgentPollWorkers, "agent-poll-workers", 10, "")
+	flags.DurationVar(&c.AgentPollTimeout, "agent-poll-timeout", 5*time.Second, "")
+	flags.StringVar(&c.Maintenance, "maintenance", "off", "")
+	flags.BoolVar(&c.MesosHealth, "mesos-health", false, "")
+	flags.StringVar(&c.CheckEnv, "check-env", "", "")
+	flags.StringVar(&c.Marathon, "marathon", "", "")
+	flags.BoolVar(&c.MarathonEvents, "marathon-events", false, "")
+	flags.DurationVar(&c.MarathonEventsInterval, "marathon-events-interval", 5*time.Second, "")
+	flags.StringVar(&c.MarathonAuth, "marathon-auth", "", "")
+	flags.BoolVar(&c.MarathonSSLVerify, "marathon-ssl-verify", true, "")
+	flags.StringVar(&c.MarathonCACert, "marathon-ssl-cacert", "", "")
+	flags.DurationVar(&c.MarathonTimeout, "marathon-timeout", 10*time.Second, "")
+	flags.StringVar(&c.ConsulAgentTemplate, "consul-agent-template", "", "")
+	flags.StringVar(&c.ConsulAgentTable, "consul-agent-table", "", "")
+	flags.BoolVar(&c.ConsulAgentDiscovery, "consul-agent-discovery", false, "")
 	flags.BoolVar(&c.Healthcheck, "healthcheck", false, "")
 	flags.StringVar(&c.HealthcheckIp, "healthcheck-ip", "127.0.0.1", "")
 	flags.StringVar(&c.HealthcheckPort, "healthcheck-port", "24476", "")
@@ -75,6 +104,19 @@ func parseFlags(args []string) (*config.Config, error) {
 		c.BlackList = append(c.BlackList, s)
 		return nil
 	}), "blacklist", "")
+	flags.StringVar(&c.RegistrationMode, "registration-mode", "all", "")
+	flags.StringVar(&c.RegistrationLabel, "registration-label", "consul=true", "")
+	flags.BoolVar(&c.IgnoreVisibility, "ignore-visibility", false, "")
+	flags.StringVar(&c.TagLabelPrefix, "tag-label-prefix", "", "")
+	flags.StringVar(&c.TagLabels, "tag-labels", "", "")
+	flags.BoolVar(&c.DiscoveryTags, "discovery-tags", false, "")
+	flags.StringVar(&c.VersionSources, "version-sources", "", "")
+	flags.StringVar(&c.VersionTag, "version-tag", "{version}", "")
+	flags.StringVar(&c.VersionMeta, "version-meta", "version", "")
+	flags.BoolVar(&c.ContainerTags, "container-tags", false, "")
+	flags.BoolVar(&c.ResourceChanges, "resource-changes", false, "")
+	flags.BoolVar(&c.InstanceIndex, "instance-index", false, "")
+	flags.StringVar(&c.InstanceLabel, "instance-label", "consul_instance", "")
 	flags.StringVar(&c.ServiceName, "service-name", "mesos", "")
 	flags.StringVar(&c.ServiceTags, "service-tags", "", "")
 
@@ -116,11 +158,27 @@ Usage: mesos-consul [options]
 Options:
 
   --version 			Print mesos-consul version
+  --config=<file>		JSON configuration file holding the rules rewriting
+				the registrations
   --log-level=<log_level>	Set the Logging level to one of [ "DEBUG", "INFO", "WARN", "ERROR" ]
 				(default "WARN")
   --refresh=<time>		Set the Mesos refresh rate (default 1m)
   --zk=<address>		Zookeeper path to Mesos (default zk://127.0.0.1:2181/mesos)
   --group-separator=<separator> Choose the group separator. Will replace _ in task names (default is empty)
+  --name-collisions=<policy>	What happens when apps of different frameworks or
+				Marathon groups produce the same service name. 'warn'
+				registers them together, 'refuse' only registers the
+				app owning the name, 'prefix' prefixes the name of the
+				others with their framework or a hash (default warn)
+  --name-replacement=<char>	Character replacing the ones not allowed in service
+				names, '-' or '_' (default -)
+  --name-max-length=<n>		Longer service names are cut and given a hash
+				suffix, e.g. 63 for DNS labels. 0 doesn't limit the
+				length (default 0)
+  --name-trim			Collapse repeated dashes and replacement characters,
+				and trim them from both ends of service names
+  --name-strict			Don't register the tasks whose service name isn't a
+				valid DNS name instead of fixing it
   --healthcheck 		Enables a http endpoint for health checks. When this
 				flag is enabled, serves a service health status on 127.0.0.1:24476 (default not enabled)
   --healthcheck-ip=<ip> 	Health check interface ip (default 127.0.0.1)
@@ -129,12 +187,96 @@ Options:
 				which github.com/mesos-utility/mesos-consul searches for the task IP
 				address. Valid options are 'netinfo', 'mesos', 'docker' and 'host'
 				(default netinfo,mesos,host)
+  --state-mode=<mode>		Where the task state is read from. 'master' reads
+				/master/state, 'agents' polls /slave(1)/state on every
+				agent listed by /master/slaves (default master)
+  --agent-poll-workers=<n>	Number of agents polled concurrently in 'agents'
+				state mode (default 10)
+  --agent-poll-timeout=<time>	Timeout of a single agent poll in 'agents' state
+				mode (default 5s)
+  --maintenance=<mode>		How agents in Mesos maintenance are reflected in Consul.
+				'node' enables the maintenance of their Consul agent,
+				'service' the maintenance of the services registered
+				for them, 'off' does nothing (default off)
+  --mesos-health		Give every task service a TTL check updated from the
+				health Mesos reports for the task on each refresh:
+				passing when healthy, critical when unhealthy and
+				warning when unknown. The TTL is 3 times the refresh
+				rate. Replaces the checks set with labels
+  --check-env=<var>,...		Comma delimited list of the environment variables of
+				mesos-consul the check labels may expand with
+				{env:NAME} (default none)
+  --marathon=<urls>		Comma separated URLs of the Marathon APIs, e.g.
+				http://marathon:8080. The health checks of the
+				Marathon apps are turned into Consul checks for the
+				ports they check, unless a check label is set
+  --marathon-events		Follow the Marathon event streams and sync the
+				apps they report as changed right away. The refresh
+				still runs as a safety net
+  --marathon-events-interval=<time> Least time between a load of the Mesos
+				state and the next one triggered by events
+				(default 5s)
+  --marathon-auth=<user:pass>	Marathon basic authentication
+  --marathon-ssl-verify		Verify the Marathon certificates (default true)
+  --marathon-ssl-cacert=<file>	CA certificates used to verify the Marathon
+				certificates
+  --marathon-timeout=<time>	Timeout of the Marathon API requests. The event
+				streams only use it to connect and wait for the
+				response headers (default 10s)
+  --consul-agent-template=<tmpl> Go template giving the address of the Consul
+				agent of a Mesos agent from .ID, .Hostname, .IP and
+				.Attributes, e.g. '{{.Hostname}}:8501' or
+				'{{index .Attributes "consul_ip"}}'. A template without
+				agent data, like 'unix:///var/run/consul.sock', maps
+				every Mesos agent to the same Consul agent and only
+				suits a single co-located agent (default is the
+				agent IP)
+  --consul-agent-table=<file>	JSON file mapping Mesos agent IDs, hostnames or IPs
+				to {"address": ..., "node": ...} of their Consul agent
+  --consul-agent-discovery	Find the Consul agent of a Mesos agent in the Consul
+				catalog by matching node names or addresses
   --heartbeats-before-remove	Number of times that registration needs to fail before removing
 				task from Consul. (default: 1)
   --whitelist=<regex>		Only register services matching the provided regex. 
                                 Can be specified multiple times
   --blacklist=<regex>           Do not register services matching the provided regex.
                                 Can be specified multiple times
+  --registration-mode=<mode>	'all' registers every task, 'opt-in' only the tasks
+				with the registration label or with an EXTERNAL or
+				CLUSTER discovery visibility (default all)
+  --registration-label=<k=v>	Label of the tasks opting in to the registration.
+				Without a value, any value but 'false' opts in
+				(default consul=true)
+  --ignore-visibility		In opt-in mode, register the tasks with a FRAMEWORK
+				discovery visibility and the registration label,
+				which are skipped otherwise
+  --tag-label-prefix=<prefix>	Labels with the prefix become tags, named after
+				the rest of the label key, e.g. consul.tag.
+  --tag-labels=<key>,...	Comma delimited list of labels that become
+				key=value tags
+  --discovery-tags		Add the labels, version, environment and location
+				of the discovery info of the tasks to their tags
+  --version-sources=<src>,...	Comma delimited list of the sources of the task
+				versions, tried in order: 'discovery' for the
+				discovery info version, 'label:<key>' for a label,
+				'image' for the Docker image tag (default none)
+  --version-tag=<format>	Tag exposing the version, where {version} is
+				replaced with it, e.g. v{version}. Empty disables
+				the tag (default {version})
+  --version-meta=<key>		Service meta key holding the version. Empty
+				disables it (default version)
+  --container-tags		Add the image=<name> and image_tag=<tag> tags of
+				the Docker image of the tasks. The full image is
+				always part of the service meta
+  --resource-changes		Update the cpus, mem, disk and gpus service meta
+				of the tasks resized in place. Otherwise the meta
+				is only updated when their agent and framework
+				have other changes (default false)
+  --instance-index		Give every task an instance index, unique within
+				its app, registered as a tag and as the
+				<name>-<index> alias service (default false)
+  --instance-label=<key>	Label setting the instance index of a task
+				(default consul_instance)
   --service-name=<name>		Service name of the Mesos hosts. (default: mesos)
   --service-tags=<tag>,...	Comma delimited list of tags to add to the mesos hosts
 				Hosts are registered as
@@ -0,0 +1,185 @@
+package mesos
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"text/template"
+
+	"github.com/mesos-utility/mesos-consul/registry"
+	"github.com/mesos-utility/mesos-consul/state"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The Consul agent of a Mesos agent is found, in order, in the static
+// agent table, in the Consul catalog by matching the node name or address,
+// or by executing the agent template. It defaults to the Mesos agent IP.
+
+// agentInfo holds the Mesos agent data available to the agent template
+type agentInfo struct {
+	ID         string
+	Hostname   string
+	IP         string
+	Attributes map[string]string
+}
+
+// agentMapping is an entry of the static agent table, keyed by Mesos agent
+// ID, hostname or IP
+type agentMapping struct {
+	Address string `json:"address"`
+	Node    string `json:"node"`
+}
+
+func parseAgentTemplate(s string) *template.Template {
+	if s == "" {
+		return nil
+	}
+
+	t, err := template.New("agent").Option("missingkey=error").Parse(s)
+	if err != nil {
+		log.WithField("template", s).Fatal("Consul agent template failed to parse: ", err)
+	}
+
+	return t
+}
+
+func loadAgentTable(file string) map[string]agentMapping {
+	if file == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.WithField("file", file).Fatal("Unable to read Consul agent table: ", err)
+	}
+
+	table := make(map[string]agentMapping)
+	if err := json.Unmarshal(data, &table); err != nil {
+		log.WithField("file", file).Fatal("Unable to parse Consul agent table: ", err)
+	}
+
+	return table
+}
+
+// mapAgents()
+//   Resolve the Consul agent of every Mesos agent and master, and hand
+//   them to the registry
+//
+func (m *Mesos) mapAgents(sj state.State) {
+	var nodes []*registry.Agent
+
+	if m.AgentDiscovery {
+		var err error
+		nodes, err = m.Registry.CatalogNodes(m.masterAgent(m.getLeader().Ip))
+		if err != nil {
+			log.Warn("Unable to list Consul nodes: ", err)
+		}
+	}
+
+	var agents []*registry.Agent
+
+	consulAgents := make(map[string]string)
+	slaveAttributes := make(map[string]map[string]string)
+	for _, s := range sj.Slaves {
+		if s.PID.UPID == nil {
+			continue
+		}
+
+		attrs := attributes(s.Attributes)
+		slaveAttributes[s.ID] = attrs
+
+		a := m.resolveAgent(agentInfo{
+			ID:         s.ID,
+			Hostname:   s.Hostname,
+			IP:         toIP(s.PID.Host),
+			Attributes: attrs,
+		}, nodes)
+
+		consulAgents[s.ID] = a.Address
+		agents = append(agents, a)
+	}
+
+	masterAgents := make(map[string]string)
+	for _, ma := range m.getMasters() {
+		a := m.resolveAgent(agentInfo{
+			Hostname: ma.Host,
+			IP:       ma.Ip,
+		}, nodes)
+
+		masterAgents[ma.Ip] = a.Address
+		agents = append(agents, a)
+	}
+
+	m.consulAgents = consulAgents
+	m.slaveAttributes = slaveAttributes
+	m.masterAgents = masterAgents
+	m.Registry.SetAgents(agents)
+}
+
+func (m *Mesos) resolveAgent(info agentInfo, nodes []*registry.Agent) *registry.Agent {
+	a := &registry.Agent{IP: info.IP, Address: info.IP}
+
+	for _, key := range []string{info.ID, info.Hostname, info.IP} {
+		if e, ok := m.agentTable[key]; ok && key != "" {
+			if e.Address != "" {
+				a.Address = e.Address
+			}
+			a.Node = e.Node
+			return a
+		}
+	}
+
+	short := strings.Split(info.Hostname, ".")[0]
+	for _, n := range nodes {
+		if n.Address == info.IP || (info.Hostname != "" && (n.Node == info.Hostname || n.Node == short)) {
+			a.Node = n.Node
+			a.Address = n.Address
+			return a
+		}
+	}
+
+	if m.agentTemplate != nil {
+		var b bytes.Buffer
+		if err := m.agentTemplate.Execute(&b, info); err != nil {
+			log.Warnf("Unable to map agent %s with the Consul agent template: %s", info.IP, err)
+		} else {
+			a.Address = b.String()
+		}
+	}
+
+	return a
+}
+
+// consulAgent()
+//   Return the Consul agent of the Mesos agent
+//
+func (m *Mesos) consulAgent(slaveID string, ip string) string {
+	if a, ok := m.consulAgents[slaveID]; ok {
+		return a
+	}
+
+	return ip
+}
+
+// masterAgent()
+//   Return the Consul agent of the Mesos master
+//
+func (m *Mesos) masterAgent(ip string) string {
+	if a, ok := m.masterAgents[ip]; ok {
+		return a
+	}
+
+	return ip
+}
+
+func attributes(attrs map[string]interface{}) map[string]string {
+	rval := make(map[string]string, len(attrs))
+	for k, v := range attrs {
+		rval[k] = fmt.Sprint(v)
+	}
+
+	return rval
+}
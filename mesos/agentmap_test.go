@@ -0,0 +1,91 @@
+package mesos
+
+import (
+	"testing"
+
+	"github.com/mesos-utility/mesos-consul/registry"
+)
+
+func TestResolveAgent(t *testing.T) {
+	info := agentInfo{
+		ID:         "S1",
+		Hostname:   "agent1.example.com",
+		IP:         "10.0.0.1",
+		Attributes: map[string]string{"consul_ip": "10.1.0.1"},
+	}
+
+	table := map[string]agentMapping{
+		"agent1.example.com": {Address: "10.2.0.1", Node: "table-node"},
+	}
+	nodes := []*registry.Agent{
+		{Node: "other", Address: "10.9.0.9"},
+		{Node: "agent1", Address: "10.3.0.1"},
+	}
+	tmpl := parseAgentTemplate(`{{index .Attributes "consul_ip"}}:8501`)
+
+	cases := []struct {
+		name     string
+		table    map[string]agentMapping
+		nodes    []*registry.Agent
+		template bool
+		address  string
+		node     string
+	}{
+		{"table first", table, nodes, true, "10.2.0.1", "table-node"},
+		{"catalog before template", nil, nodes, true, "10.3.0.1", "agent1"},
+		{"template", nil, nil, true, "10.1.0.1:8501", ""},
+		{"template without match", nil, []*registry.Agent{{Node: "other", Address: "10.9.0.9"}}, true, "10.1.0.1:8501", ""},
+		{"default", nil, nil, false, "10.0.0.1", ""},
+	}
+
+	for _, c := range cases {
+		m := &Mesos{agentTable: c.table}
+		if c.template {
+			m.agentTemplate = tmpl
+		}
+
+		a := m.resolveAgent(info, c.nodes)
+		if a.Address != c.address || a.Node != c.node {
+			t.Errorf("%s: agent = %s/%s, want %s/%s", c.name, a.Node, a.Address, c.node, c.address)
+		}
+		if a.IP != info.IP {
+			t.Errorf("%s: IP = %s, want %s", c.name, a.IP, info.IP)
+		}
+	}
+}
+
+func TestResolveAgent_Keys(t *testing.T) {
+	info := agentInfo{ID: "S1", Hostname: "agent1.example.com", IP: "10.0.0.1"}
+
+	// The table is looked up by agent ID, hostname and IP, and an entry
+	// without address only names the node
+	for key, want := range map[string]string{"S1": "10.2.0.1", "agent1.example.com": "10.2.0.2", "10.0.0.1": "10.0.0.1"} {
+		m := &Mesos{agentTable: map[string]agentMapping{key: {Address: want, Node: "node"}}}
+		if key == "10.0.0.1" {
+			m.agentTable[key] = agentMapping{Node: "node"}
+		}
+
+		a := m.resolveAgent(info, nil)
+		if a.Address != want || a.Node != "node" {
+			t.Errorf("%s: agent = %s/%s, want node/%s", key, a.Node, a.Address, want)
+		}
+	}
+
+	// Catalog nodes match the IP, the hostname or the short hostname
+	for _, n := range []*registry.Agent{
+		{Node: "x", Address: "10.0.0.1"},
+		{Node: "agent1.example.com", Address: "10.3.0.1"},
+		{Node: "agent1", Address: "10.3.0.1"},
+	} {
+		a := (&Mesos{}).resolveAgent(info, []*registry.Agent{n})
+		if a.Node != n.Node || a.Address != n.Address {
+			t.Errorf("%s: agent = %s/%s", n.Node, a.Node, a.Address)
+		}
+	}
+
+	// A failing template keeps the agent IP
+	m := &Mesos{agentTemplate: parseAgentTemplate(`{{index .Attributes "consul_ip"}}{{.Missing}}`)}
+	if a := m.resolveAgent(info, nil); a.Address != info.IP {
+		t.Errorf("failed template: address = %s, want %s", a.Address, info.IP)
+	}
+}
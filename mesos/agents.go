@@ -0,0 +1,119 @@
+package mesos
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/mesos-utility/mesos-consul/state"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type agentResult struct {
+	slave state.Slave
+	state state.SlaveState
+	err   error
+}
+
+// loadFromAgents()
+//   Build the state from the agent list of the master and the
+//   state of every single agent
+//
+func (m *Mesos) loadFromAgents(ip string, port string) (sj state.State, err error) {
+	var slaves state.Slaves
+
+	client := &http.Client{Timeout: m.AgentPollTimeout}
+
+	err = getJSON(client, "http://"+ip+":"+port+"/master/slaves", &slaves)
+	if err != nil {
+		return
+	}
+
+	sj.Leader = fmt.Sprintf("master@%s:%s", ip, port)
+	sj.Slaves = slaves.Slaves
+
+	jobs := make(chan state.Slave)
+	results := make(chan agentResult)
+
+	var wg sync.WaitGroup
+	for i := 0; i < m.AgentPollWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s := range jobs {
+				ss, err := loadFromAgent(client, s)
+				results <- agentResult{slave: s, state: ss, err: err}
+			}
+		}()
+	}
+
+	go func() {
+		for _, s := range sj.Slaves {
+			jobs <- s
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	for r := range results {
+		if r.err != nil {
+			log.Warnf("Unable to poll agent %s: %s", r.slave.ID, r.err.Error())
+			sj.Unreachable = append(sj.Unreachable, r.slave)
+			continue
+		}
+
+		sj.AddSlaveState(r.state)
+	}
+
+	return sj, nil
+}
+
+func loadFromAgent(client *http.Client, s state.Slave) (ss state.SlaveState, err error) {
+	if s.PID.UPID == nil {
+		err = fmt.Errorf("no pid for agent %s", s.ID)
+		return
+	}
+
+	url := fmt.Sprintf("http://%s:%s/%s/state", s.PID.Host, s.PID.Port, s.PID.ID)
+	log.Debugf("Polling agent %s at %s", s.ID, url)
+
+	err = getJSON(client, url, &ss)
+	if err != nil {
+		return
+	}
+
+	if ss.ID == "" {
+		ss.ID = s.ID
+	}
+
+	return ss, nil
+}
+
+func getJSON(client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(body, v)
+}
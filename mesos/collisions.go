@@ -0,0 +1,229 @@
+package mesos
+
+import (
+	"expvar"
+	"fmt"
+	"hash/fnv"
+	"sort"
+
+	"github.com/mesos-utility/mesos-consul/state"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// identity is what tells apart the tasks that should share a service
+// name: the framework and the raw task name, which holds the app
+type identity struct {
+	Framework string `json:"framework"`
+	Name      string `json:"name"`
+}
+
+func (id identity) String() string {
+	return id.Framework + "/" + id.Name
+}
+
+func taskIdentity(t *state.Task) identity {
+	return identity{Framework: t.FrameworkName, Name: t.Name}
+}
+
+// detectCollisions()
+//   Find the service names produced by several identities. The identity
+//   that had the name first keeps it.
+//
+func (m *Mesos) detectCollisions(sj state.State) {
+	seen := make(map[string]map[identity]bool)
+	changes := make(map[string]nameChange)
+
+	for _, fw := range sj.Frameworks {
+		for i := range fw.Tasks {
+			task := &fw.Tasks[i]
+			if _, ok := m.Agents[task.SlaveID]; !ok || task.State != "TASK_RUNNING" {
+				continue
+			}
+
+			task.FrameworkName = fw.Name
+			if !m.taskFilter(task) {
+				continue
+			}
+
+			for _, raw := range m.taskNames(task) {
+				name, err := m.sanitizeName(raw)
+				m.recordName(changes, raw, name, err)
+				if err != nil {
+					continue
+				}
+
+				if seen[name] == nil {
+					seen[name] = make(map[identity]bool)
+				}
+				seen[name][taskIdentity(task)] = true
+			}
+		}
+	}
+
+	owners := make(map[string]identity, len(seen))
+	collisions := make(map[string][]identity)
+	for name, ids := range seen {
+		var sorted []identity
+		for id := range ids {
+			sorted = append(sorted, id)
+		}
+		sort.Sort(byIdentity(sorted))
+
+		owner, ok := m.nameOwners[name]
+		if !ok || !ids[owner] {
+			owner = sorted[0]
+		}
+		owners[name] = owner
+
+		if len(sorted) > 1 {
+			if _, known := m.collisions[name]; !known {
+				log.Warnf("Service name %s produced by %v, owned by %s", name, sorted, owner)
+			}
+			collisions[name] = sorted
+		}
+	}
+
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+
+	m.nameOwners = owners
+	m.collisions = collisions
+	m.nameChanges = changes
+}
+
+// taskNames()
+//   Return the names the services of the task are registered under
+//   before the name policy: the task name, or the names rules rename
+//   them to
+//
+func (m *Mesos) taskNames(t *state.Task) []string {
+	if m.rules == nil {
+		return []string{t.Name}
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, port := range portNames(t) {
+		name := m.rules.Rename(m.ruleContext(t, port))
+		if name == "" {
+			name = t.Name
+		}
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// portNames()
+//   Return the port names of the services of the task, as set by
+//   taskServices
+//
+func portNames(t *state.Task) []string {
+	var names []string
+
+	ports := t.Resources.Ports()
+	for i, port := range ports {
+		for _, p := range portInfo(t, toPort(port), i) {
+			names = append(names, p.name)
+		}
+	}
+
+	if len(ports) == 0 {
+		names = append(names, "")
+		for _, p := range t.DiscoveryInfo.Ports.DiscoveryPorts {
+			if p.Name != "" {
+				names = append(names, p.Name)
+			}
+		}
+	}
+
+	return names
+}
+
+// serviceName()
+//   Return the service name of the task, or why the task may not be
+//   registered under it according to the name and collision policies
+//
+func (m *Mesos) serviceName(t *state.Task) (string, error) {
+	return m.resolveName(t.Name, taskIdentity(t))
+}
+
+// resolveName()
+//   Turn a name of the identity into a service name according to the
+//   name and collision policies
+//
+func (m *Mesos) resolveName(raw string, id identity) (string, error) {
+	name, err := m.sanitizeName(raw)
+	if err != nil {
+		return "", err
+	}
+
+	owner, ok := m.nameOwners[name]
+	if !ok || owner == id {
+		return name, nil
+	}
+
+	switch m.NameCollisions {
+	case "refuse":
+		return "", fmt.Errorf("service name %s taken by %s", name, owner)
+	case "prefix":
+		return m.sanitizeName(namespace(owner, id) + "-" + name)
+	default:
+		return name, nil
+	}
+}
+
+// namespace()
+//   Return the prefix telling the identity apart from the owner of the
+//   name: the framework when they differ, a hash of the task name
+//   otherwise
+//
+func namespace(owner, id identity) string {
+	if owner.Framework != id.Framework && id.Framework != "" {
+		return id.Framework
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(id.Name))
+	return fmt.Sprintf("%06x", h.Sum32()&0xffffff)
+}
+
+// collisionReport()
+//   Report of the colliding service names, with the identities
+//   producing them, published on /debug/vars
+//
+func (m *Mesos) collisionReport() interface{} {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+
+	report := make(map[string]interface{}, len(m.collisions))
+	for name, ids := range m.collisions {
+		report[name] = map[string]interface{}{
+			"owner":      m.nameOwners[name],
+			"identities": ids,
+			"policy":     m.NameCollisions,
+		}
+	}
+
+	return report
+}
+
+func (m *Mesos) publishCollisions() {
+	expvar.Publish("collisions", expvar.Func(m.collisionReport))
+	stats.Set("name_collisions", expvar.Func(func() interface{} {
+		m.Lock.Lock()
+		defer m.Lock.Unlock()
+
+		return len(m.collisions)
+	}))
+}
+
+type byIdentity []identity
+
+func (s byIdentity) Len() int           { return len(s) }
+func (s byIdentity) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byIdentity) Less(i, j int) bool { return s[i].String() < s[j].String() }
@@ -0,0 +1,145 @@
+package mesos
+
+import (
+	"testing"
+
+	"github.com/mesos-utility/mesos-consul/rules"
+	"github.com/mesos-utility/mesos-consul/state"
+)
+
+func TestDetectCollisions(t *testing.T) {
+	sj := state.State{Frameworks: []state.Framework{
+		{Name: "marathon", Tasks: []state.Task{
+			{ID: "1", Name: "api.dev", SlaveID: "s1", State: "TASK_RUNNING"},
+			{ID: "2", Name: "api-dev", SlaveID: "s1", State: "TASK_RUNNING"},
+		}},
+		{Name: "aurora", Tasks: []state.Task{
+			{ID: "3", Name: "api_dev", SlaveID: "s1", State: "TASK_RUNNING"},
+			{ID: "4", Name: "web", SlaveID: "s1", State: "TASK_RUNNING"},
+		}},
+	}}
+
+	m := &Mesos{
+		Agents:           map[string]string{"s1": "10.0.0.1"},
+		RegistrationMode: "all",
+		NameCollisions:   "prefix",
+		Separator:        "-",
+	}
+	m.detectCollisions(sj)
+
+	if len(m.collisions) != 1 || len(m.collisions["api-dev"]) != 3 {
+		t.Fatalf("unexpected collisions %v", m.collisions)
+	}
+
+	owner := m.nameOwners["api-dev"]
+	if owner != (identity{Framework: "aurora", Name: "api_dev"}) {
+		t.Errorf("unexpected owner %v", owner)
+	}
+
+	if name, err := m.serviceName(&sj.Frameworks[1].Tasks[0]); err != nil || name != "api-dev" {
+		t.Errorf("owner renamed to %q", name)
+	}
+	if name, err := m.serviceName(&sj.Frameworks[0].Tasks[0]); err != nil || name != "marathon-api-dev" {
+		t.Errorf("expected the framework prefix, got %q", name)
+	}
+
+	// The owner keeps the name as long as it runs
+	sj.Frameworks[0].Tasks = append(sj.Frameworks[0].Tasks, state.Task{ID: "5", Name: "api.dev", SlaveID: "s1", State: "TASK_RUNNING"})
+	m.detectCollisions(sj)
+	if m.nameOwners["api-dev"] != owner {
+		t.Errorf("owner changed to %v", m.nameOwners["api-dev"])
+	}
+
+	m.NameCollisions = "refuse"
+	if _, err := m.serviceName(&sj.Frameworks[0].Tasks[1]); err == nil {
+		t.Error("colliding task should be refused")
+	}
+}
+
+func TestRenamedCollisions(t *testing.T) {
+	engine, err := rules.New([]rules.Rule{{
+		Name:    "rename-web",
+		Match:   rules.Match{TaskName: "^web$"},
+		Actions: rules.Actions{Rename: "API.dev"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sj := state.State{Frameworks: []state.Framework{
+		{Name: "aurora", Tasks: []state.Task{
+			{ID: "1", Name: "api_dev", SlaveID: "s1", State: "TASK_RUNNING"},
+		}},
+		{Name: "marathon", Tasks: []state.Task{
+			{ID: "2", Name: "web", SlaveID: "s1", State: "TASK_RUNNING", SlaveIP: "10.0.0.1"},
+		}},
+	}}
+
+	m := &Mesos{
+		Agents:           map[string]string{"s1": "10.0.0.1"},
+		RegistrationMode: "all",
+		NameCollisions:   "refuse",
+		Separator:        "-",
+		IpOrder:          []string{"host"},
+		rules:            engine,
+	}
+	m.detectCollisions(sj)
+
+	if ids := m.collisions["api-dev"]; len(ids) != 2 {
+		t.Fatalf("expected the renamed service to collide, got %v", m.collisions)
+	}
+	if _, ok := m.nameOwners["web"]; ok {
+		t.Errorf("the name of a renamed task shouldn't be claimed")
+	}
+
+	if services := m.taskServices(&sj.Frameworks[1].Tasks[0], "10.0.0.1"); len(services) != 0 {
+		t.Errorf("expected the renamed service to be refused, got %v", services[0].Name)
+	}
+
+	m.NameCollisions = "prefix"
+	services := m.taskServices(&sj.Frameworks[1].Tasks[0], "10.0.0.1")
+	if len(services) != 1 || services[0].Name != "marathon-api-dev" {
+		t.Errorf("expected the renamed service to be sanitised and prefixed, got %+v", services)
+	}
+}
+
+func TestRenamedAwayCollisions(t *testing.T) {
+	engine, err := rules.New([]rules.Rule{{
+		Name:    "rename-marathon-api",
+		Match:   rules.Match{Framework: "^marathon$"},
+		Actions: rules.Actions{Rename: "web"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sj := state.State{Frameworks: []state.Framework{
+		{Name: "aurora", Tasks: []state.Task{
+			{ID: "1", Name: "api_dev", SlaveID: "s1", State: "TASK_RUNNING"},
+		}},
+		{Name: "marathon", Tasks: []state.Task{
+			{ID: "2", Name: "api_dev", SlaveID: "s1", State: "TASK_RUNNING", SlaveIP: "10.0.0.1"},
+		}},
+	}}
+
+	m := &Mesos{
+		Agents:           map[string]string{"s1": "10.0.0.1"},
+		RegistrationMode: "all",
+		NameCollisions:   "refuse",
+		Separator:        "-",
+		IpOrder:          []string{"host"},
+		rules:            engine,
+	}
+	m.detectCollisions(sj)
+
+	// The task would collide with the aurora one, but the rule renames it
+	// away from the name
+	services := m.taskServices(&sj.Frameworks[1].Tasks[0], "10.0.0.1")
+	if len(services) != 1 || services[0].Name != "web" {
+		t.Errorf("expected the service renamed away to be registered, got %+v", services)
+	}
+
+	if services := m.taskServices(&sj.Frameworks[0].Tasks[0], "10.0.0.1"); len(services) != 1 || services[0].Name != "api-dev" {
+		t.Errorf("expected the owner to keep its name, got %+v", services)
+	}
+}
@@ -0,0 +1,236 @@
+package mesos
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Marathon events that change the tasks of an app
+var marathonEvents = []string{
+	"status_update_event",
+	"health_status_changed_event",
+	"deployment_success",
+	"deployment_failed",
+}
+
+// How long events are collected before the affected apps are synced
+const eventBatch = time.Second
+
+const (
+	minEventBackoff = time.Second
+	maxEventBackoff = time.Minute
+)
+
+// marathonEvent holds the fields of the Marathon events that designate
+// the affected apps
+type marathonEvent struct {
+	AppID  string `json:"appId"`
+	TaskID string `json:"taskId"`
+	Plan   struct {
+		Steps []struct {
+			Actions []struct {
+				App string `json:"app"`
+			} `json:"actions"`
+		} `json:"steps"`
+	} `json:"plan"`
+}
+
+// apps()
+//   Return the apps affected by the event
+//
+func (e *marathonEvent) apps() []string {
+	var apps []string
+
+	if e.AppID != "" {
+		apps = append(apps, e.AppID)
+	}
+	for _, step := range e.Plan.Steps {
+		for _, action := range step.Actions {
+			if action.App != "" {
+				apps = append(apps, action.App)
+			}
+		}
+	}
+
+	return apps
+}
+
+// Triggers()
+//   Return the channel of the sets of apps changed according to the
+//   Marathon event streams
+//
+func (m *Mesos) Triggers() <-chan map[string]bool {
+	return m.triggers
+}
+
+// subscribeEvents()
+//   Follow the event streams of the Marathon instances and batch the
+//   apps they report as changed
+//
+func (m *Mesos) subscribeEvents() {
+	events := make(chan string)
+	m.triggers = make(chan map[string]bool)
+
+	for _, instance := range m.Marathon {
+		go m.followEvents(instance, events)
+	}
+
+	// Events keep being collected while the previous batch waits for
+	// the main loop, or for the events interval to elapse
+	go func() {
+		apps := make(map[string]bool)
+		var timeout <-chan time.Time
+		var out chan map[string]bool
+
+		for {
+			select {
+			case app := <-events:
+				apps[app] = true
+				if timeout == nil && out == nil {
+					timeout = time.After(eventBatch)
+				}
+			case <-timeout:
+				if wait := m.syncDelay(time.Now()); wait > 0 {
+					timeout = time.After(wait)
+					continue
+				}
+				timeout, out = nil, m.triggers
+			case out <- apps:
+				apps, out = make(map[string]bool), nil
+			}
+		}
+	}()
+}
+
+// syncDelay()
+//   Time left before the state may be loaded again for the events. The
+//   loads of the refreshes and of the syncs are spread by the events
+//   interval, so a deployment doesn't fetch the whole state every second.
+//
+func (m *Mesos) syncDelay(now time.Time) time.Duration {
+	last := time.Unix(0, atomic.LoadInt64(&m.lastLoad))
+
+	return m.EventsInterval - now.Sub(last)
+}
+
+// followEvents()
+//   Read the event stream of the Marathon instance, reconnecting with
+//   an exponential backoff
+//
+func (m *Mesos) followEvents(instance string, events chan<- string) {
+	backoff := minEventBackoff
+
+	for {
+		start := time.Now()
+		err := m.readEvents(instance, events)
+		log.Warnf("Marathon %s event stream closed: %v", instance, err)
+		stats.Add("marathon_event_reconnects", 1)
+
+		// A stream that stayed up for a while starts over from the
+		// minimum backoff
+		if time.Since(start) > maxEventBackoff {
+			backoff = minEventBackoff
+		}
+
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxEventBackoff {
+			backoff = maxEventBackoff
+		}
+	}
+}
+
+// readEvents()
+//   Read the server-sent events of the Marathon instance until the
+//   stream ends
+//
+func (m *Mesos) readEvents(instance string, events chan<- string) error {
+	url := instance + "/v2/events?event_type=" + strings.Join(marathonEvents, "&event_type=")
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	// No overall timeout, the stream stays open. The transport limits
+	// the time to connect and to get the response headers.
+	client := &http.Client{Transport: m.marathonTransport}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	log.Infof("Following the event stream of Marathon %s", instance)
+
+	return m.parseEvents(resp.Body, events)
+}
+
+// parseEvents()
+//   Dispatch the server-sent events read from the stream until it ends
+//
+func (m *Mesos) parseEvents(r io.Reader, events chan<- string) error {
+	var event string
+	var data []string
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case line == "":
+			if len(data) > 0 {
+				m.dispatchEvent(event, strings.Join(data, "\n"), events)
+			}
+			event, data = "", nil
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("end of stream")
+}
+
+// dispatchEvent()
+//   Send the apps affected by a relevant event
+//
+func (m *Mesos) dispatchEvent(event string, data string, events chan<- string) {
+	relevant := false
+	for _, e := range marathonEvents {
+		if e == event {
+			relevant = true
+		}
+	}
+	if !relevant {
+		return
+	}
+
+	var e marathonEvent
+	if err := json.Unmarshal([]byte(data), &e); err != nil {
+		log.Warnf("Unable to parse Marathon %s: %s", event, err)
+		return
+	}
+
+	stats.Add("marathon_events", 1)
+	for _, app := range e.apps() {
+		log.Debugf("Marathon %s for %s", event, app)
+		events <- app
+	}
+}
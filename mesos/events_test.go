@@ -0,0 +1,182 @@
+package mesos
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mesos-utility/mesos-consul/config"
+)
+
+const eventStream = `event: status_update_event
+data: {"appId":"/web","taskId":"web.1"}
+
+: comment lines are ignored
+event: health_status_changed_event
+data: {"appId":"/api",
+data: "taskId":"api.1"}
+
+event: event_stream_attached
+data: {"remoteAddress":"10.0.0.1"}
+
+event: deployment_success
+data: {"plan":{"steps":[{"actions":[{"app":"/db"},{"app":"/cache"}]}]}}
+
+event: deployment_failed
+data: not json
+
+data: {"appId":"/untyped"}
+
+event: status_update_event
+data: {"appId":"/unterminated"}`
+
+func collectEvents(parse func(chan<- string) error) ([]string, error) {
+	events := make(chan string, 16)
+	err := parse(events)
+	close(events)
+
+	var apps []string
+	for app := range events {
+		apps = append(apps, app)
+	}
+
+	return apps, err
+}
+
+func TestParseEvents(t *testing.T) {
+	m := &Mesos{}
+
+	apps, err := collectEvents(func(events chan<- string) error {
+		return m.parseEvents(strings.NewReader(eventStream), events)
+	})
+	if err == nil || err.Error() != "end of stream" {
+		t.Errorf("error = %v, want end of stream", err)
+	}
+
+	// The untyped, unparsable, irrelevant and unterminated events are
+	// dropped
+	want := []string{"/web", "/api", "/db", "/cache"}
+	if !reflect.DeepEqual(apps, want) {
+		t.Errorf("apps = %v, want %v", apps, want)
+	}
+}
+
+func TestDispatchEvent(t *testing.T) {
+	m := &Mesos{}
+
+	cases := []struct {
+		event string
+		data  string
+		want  []string
+	}{
+		{"status_update_event", `{"appId":"/web","taskId":"web.1"}`, []string{"/web"}},
+		{"health_status_changed_event", `{"appId":"/web"}`, []string{"/web"}},
+		{"deployment_success", `{"plan":{"steps":[{"actions":[{"app":"/a"}]},{"actions":[{"app":"/b"},{}]}]}}`, []string{"/a", "/b"}},
+		{"deployment_failed", `{"plan":{"steps":[]}}`, nil},
+		{"api_post_event", `{"appId":"/web"}`, nil},
+		{"status_update_event", `{"appId":`, nil},
+	}
+
+	for _, c := range cases {
+		apps, _ := collectEvents(func(events chan<- string) error {
+			m.dispatchEvent(c.event, c.data, events)
+			return nil
+		})
+		if !reflect.DeepEqual(apps, c.want) {
+			t.Errorf("%s %s: apps = %v, want %v", c.event, c.data, apps, c.want)
+		}
+	}
+}
+
+func TestReadEvents(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/events" {
+			http.NotFound(w, r)
+			return
+		}
+		if got := r.Header.Get("Accept"); got != "text/event-stream" {
+			t.Errorf("Accept = %q", got)
+		}
+		if got := r.URL.Query()["event_type"]; !reflect.DeepEqual(got, marathonEvents) {
+			t.Errorf("event_type = %v, want %v", got, marathonEvents)
+		}
+
+		w.Write([]byte(eventStream))
+	}))
+	defer ts.Close()
+
+	m := &Mesos{}
+	apps, err := collectEvents(func(events chan<- string) error {
+		return m.readEvents(ts.URL, events)
+	})
+	if err == nil {
+		t.Error("expected the end of the stream to be reported")
+	}
+	if want := []string{"/web", "/api", "/db", "/cache"}; !reflect.DeepEqual(apps, want) {
+		t.Errorf("apps = %v, want %v", apps, want)
+	}
+
+	if _, err := collectEvents(func(events chan<- string) error {
+		return m.readEvents(ts.URL+"/missing", events)
+	}); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("error = %v, want the status", err)
+	}
+}
+
+func TestReadEvents_Timeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/slow/") {
+			time.Sleep(200 * time.Millisecond)
+			return
+		}
+
+		// Events keep coming for longer than the Marathon timeout
+		w.WriteHeader(http.StatusOK)
+		for i := 0; i < 4; i++ {
+			fmt.Fprintf(w, "event: status_update_event\ndata: {\"appId\":\"/app%d\"}\n\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	defer ts.Close()
+
+	m := &Mesos{marathonTransport: marathonTransport(&config.Config{MarathonTimeout: 100 * time.Millisecond})}
+
+	apps, _ := collectEvents(func(events chan<- string) error {
+		return m.readEvents(ts.URL, events)
+	})
+	if want := []string{"/app0", "/app1", "/app2", "/app3"}; !reflect.DeepEqual(apps, want) {
+		t.Errorf("apps = %v, want %v", apps, want)
+	}
+
+	// A Marathon that doesn't answer is given up on
+	if _, err := collectEvents(func(events chan<- string) error {
+		return m.readEvents(ts.URL+"/slow", events)
+	}); err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("error = %v, want a timeout", err)
+	}
+}
+
+func TestSyncDelay(t *testing.T) {
+	now := time.Unix(1000, 0)
+	m := &Mesos{EventsInterval: 5 * time.Second}
+
+	if wait := m.syncDelay(now); wait > 0 {
+		t.Errorf("wait = %s before any load", wait)
+	}
+
+	atomic.StoreInt64(&m.lastLoad, now.Add(-2*time.Second).UnixNano())
+	if wait := m.syncDelay(now); wait != 3*time.Second {
+		t.Errorf("wait = %s, want 3s", wait)
+	}
+
+	atomic.StoreInt64(&m.lastLoad, now.Add(-time.Minute).UnixNano())
+	if wait := m.syncDelay(now); wait > 0 {
+		t.Errorf("wait = %s after the interval", wait)
+	}
+}
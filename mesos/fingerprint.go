@@ -0,0 +1,124 @@
+package mesos
+
+import (
+	"expvar"
+	"fmt"
+	"hash/fnv"
+	"sort"
+
+	"github.com/mesos-utility/mesos-consul/state"
+)
+
+// Sync counters, published on /debug/vars of the healthcheck endpoint
+var stats = expvar.NewMap("mesos")
+
+// A partition groups the running tasks of a framework on a single agent.
+// The fingerprint covers everything registerTask looks at, so a partition
+// with an unchanged fingerprint doesn't need to be walked again.
+type partition struct {
+	fingerprint uint64
+	ids         []string
+
+	// Maintenance reasons of the services, from the task labels
+	maintenance map[string]string
+
+	// Services of every task
+	tasks map[string][]string
+}
+
+type taskGroup struct {
+	key   string
+	slave string
+	agent string
+	tasks []*state.Task
+}
+
+// partitionTasks()
+//   Group the running tasks on known agents by agent and framework
+//
+func (m *Mesos) partitionTasks(sj state.State) []*taskGroup {
+	var groups []*taskGroup
+	index := make(map[string]*taskGroup)
+
+	hostnames := make(map[string]string)
+	for _, s := range sj.Slaves {
+		hostnames[s.ID] = s.Hostname
+	}
+
+	for _, fw := range sj.Frameworks {
+		for i := range fw.Tasks {
+			task := &fw.Tasks[i]
+
+			agent, ok := m.Agents[task.SlaveID]
+			if !ok || task.State != "TASK_RUNNING" {
+				continue
+			}
+			task.SlaveIP = agent
+			task.SlaveHostname = hostnames[task.SlaveID]
+			task.FrameworkName = fw.Name
+
+			key := task.SlaveID + "/" + task.FrameworkID
+			g, ok := index[key]
+			if !ok {
+				g = &taskGroup{key: key, slave: task.SlaveID, agent: agent}
+				index[key] = g
+				groups = append(groups, g)
+			}
+			g.tasks = append(g.tasks, task)
+		}
+	}
+
+	return groups
+}
+
+// fingerprint()
+//   Hash the task IDs, service names, versions, instance indexes, states,
+//   containers, health, Marathon versions, IPs, ports and labels of a
+//   task group, and their resources when asked to
+//
+func (m *Mesos) fingerprint(g *taskGroup) uint64 {
+	tasks := make([]*state.Task, len(g.tasks))
+	copy(tasks, g.tasks)
+	sort.Sort(byTaskID(tasks))
+
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s %s\n", g.agent, m.consulAgent(g.slave, g.agent))
+	for _, t := range tasks {
+		name, err := m.serviceName(t)
+		fmt.Fprintf(h, "%s|%s|%s %v|%s|%s|%s|%s|%v|%s|%v|", t.ID, t.Name, name, err, m.taskVersion(t), t.State, taskHealth(t), m.marathonVersion(t), t.IPs(m.IpOrder...), t.Resources.PortRanges, t.Container)
+		if i, ok := m.instanceIndex(t); ok {
+			fmt.Fprintf(h, "%d|", i)
+		}
+		if m.ResourceChanges {
+			fmt.Fprintf(h, "%v|%v|%v|%v|", t.CPUs, t.Mem, t.Disk, t.GPUs)
+		}
+		for _, p := range t.DiscoveryInfo.Ports.DiscoveryPorts {
+			fmt.Fprintf(h, "%s:%s:%d,", p.Name, p.Protocol, p.Number)
+		}
+		for _, l := range t.Labels {
+			fmt.Fprintf(h, "%q=%q,", l.Key, l.Value)
+		}
+		fmt.Fprintln(h)
+	}
+
+	return h.Sum64()
+}
+
+// isCached()
+//   Check that every service of a partition made it into the cache
+//
+func (m *Mesos) isCached(ids []string) bool {
+	for _, id := range ids {
+		if m.Registry.CacheLookup(id) == nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+type byTaskID []*state.Task
+
+func (t byTaskID) Len() int           { return len(t) }
+func (t byTaskID) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t byTaskID) Less(i, j int) bool { return t[i].ID < t[j].ID }
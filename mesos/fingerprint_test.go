@@ -0,0 +1,46 @@
+package mesos
+
+import (
+	"testing"
+
+	"github.com/mesos-utility/mesos-consul/state"
+)
+
+func TestFingerprint(t *testing.T) {
+	m := &Mesos{IpOrder: []string{"host"}}
+
+	a := state.Task{ID: "a", State: "TASK_RUNNING", SlaveIP: "10.0.0.1"}
+	b := state.Task{ID: "b", State: "TASK_RUNNING", SlaveIP: "10.0.0.1"}
+
+	fp1 := m.fingerprint(&taskGroup{agent: "10.0.0.1", tasks: []*state.Task{&a, &b}})
+	fp2 := m.fingerprint(&taskGroup{agent: "10.0.0.1", tasks: []*state.Task{&b, &a}})
+	if fp1 != fp2 {
+		t.Errorf("fingerprint depends on task order: %x != %x", fp1, fp2)
+	}
+
+	b.Labels = []state.Label{{Key: "tags", Value: "x"}}
+	fp3 := m.fingerprint(&taskGroup{agent: "10.0.0.1", tasks: []*state.Task{&a, &b}})
+	if fp1 == fp3 {
+		t.Errorf("fingerprint ignores label change")
+	}
+}
+
+func TestFingerprint_Resources(t *testing.T) {
+	a := state.Task{ID: "a", State: "TASK_RUNNING"}
+	a.Resources.Mem = 128
+	g := &taskGroup{agent: "10.0.0.1", tasks: []*state.Task{&a}}
+
+	m := &Mesos{}
+	fp := m.fingerprint(g)
+	a.Resources.Mem = 256
+	if m.fingerprint(g) != fp {
+		t.Errorf("fingerprint follows resources without resource changes")
+	}
+
+	m.ResourceChanges = true
+	fp = m.fingerprint(g)
+	a.Resources.Mem = 512
+	if m.fingerprint(g) == fp {
+		t.Errorf("fingerprint ignores resource change")
+	}
+}
@@ -0,0 +1,192 @@
+package mesos
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mesos-utility/mesos-consul/state"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Every task of an app gets an instance index, unique within the app. An
+// index set with the instance label wins. Otherwise tasks keep the index
+// they had on the previous refresh, or after a restart the one registered
+// in their service meta, and new tasks take the lowest free indexes,
+// usually the ones of the tasks they replace. New tasks are ordered as
+// Marathon lists them when the Marathon API is set, else by start time.
+
+// assignInstances()
+//   Give an instance index to the running tasks. Refreshes and syncs both
+//   assign the indexes of the whole state, so a task synced on an event
+//   keeps its index on the next refresh.
+//
+func (m *Mesos) assignInstances(sj state.State) {
+	if !m.InstanceIndex {
+		return
+	}
+
+	apps := make(map[identity][]*state.Task)
+	for _, fw := range sj.Frameworks {
+		for i := range fw.Tasks {
+			task := &fw.Tasks[i]
+			if _, ok := m.Agents[task.SlaveID]; !ok || task.State != "TASK_RUNNING" {
+				continue
+			}
+
+			task.FrameworkName = fw.Name
+			if !m.taskFilter(task) {
+				continue
+			}
+
+			id := taskIdentity(task)
+			apps[id] = append(apps[id], task)
+		}
+	}
+
+	// Nothing is known of the indexes since the start, recover them from
+	// the cached registrations
+	restored := m.instances == nil
+
+	instances := make(map[string]int)
+	for _, tasks := range apps {
+		sort.Sort(&byInstanceOrder{tasks: tasks, marathon: m.marathonTasks})
+		used := make(map[int]bool)
+
+		for _, t := range tasks {
+			if i, ok := m.labelIndex(t); ok {
+				if used[i] {
+					log.WithField("task", t.ID).Warnf("Instance index %d used twice in %s", i, t.Name)
+				}
+				instances[t.ID] = i
+				used[i] = true
+			}
+		}
+
+		var pending []*state.Task
+		for _, t := range tasks {
+			if _, ok := instances[t.ID]; ok {
+				continue
+			}
+			i, ok := m.instances[t.ID]
+			if !ok && restored {
+				i, ok = m.cachedInstance(t)
+			}
+			if ok && !used[i] {
+				instances[t.ID] = i
+				used[i] = true
+				continue
+			}
+			pending = append(pending, t)
+		}
+
+		next := 0
+		for _, t := range pending {
+			for used[next] {
+				next++
+			}
+			instances[t.ID] = next
+			used[next] = true
+		}
+	}
+
+	m.instances = instances
+}
+
+// cachedInstance()
+//   Return the instance index registered in the service meta of the task
+//
+func (m *Mesos) cachedInstance(t *state.Task) (int, bool) {
+	t.SlaveIP = m.Agents[t.SlaveID]
+
+	for _, s := range m.taskServices(t, t.SlaveIP) {
+		cached := m.Registry.CacheLookup(s.ID)
+		if cached == nil {
+			continue
+		}
+
+		if i, err := strconv.Atoi(cached.Meta["instance"]); err == nil && i >= 0 {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+// labelIndex()
+//   Return the instance index set with the instance label
+//
+func (m *Mesos) labelIndex(t *state.Task) (int, bool) {
+	l := strings.TrimSpace(t.Label(m.InstanceLabel))
+	if l == "" {
+		return 0, false
+	}
+
+	i, err := strconv.Atoi(l)
+	if err != nil || i < 0 {
+		log.WithField("task", t.ID).Warnf("Invalid instance index '%s'", l)
+		return 0, false
+	}
+
+	return i, true
+}
+
+// instanceIndex()
+//   Return the instance index of the task, if it has one
+//
+func (m *Mesos) instanceIndex(t *state.Task) (int, bool) {
+	i, ok := m.instances[t.ID]
+	return i, ok
+}
+
+// instanceTags()
+//   Return the instance index tag of the task, if any
+//
+func (m *Mesos) instanceTags(t *state.Task) []string {
+	if i, ok := m.instanceIndex(t); ok {
+		return []string{strconv.Itoa(i)}
+	}
+
+	return nil
+}
+
+// startTime()
+//   Timestamp of the oldest status of the task
+//
+func startTime(t *state.Task) float64 {
+	var start float64
+	for _, s := range t.Statuses {
+		if start == 0 || s.Timestamp < start {
+			start = s.Timestamp
+		}
+	}
+
+	return start
+}
+
+// byInstanceOrder sorts the tasks as Marathon lists them, then the ones
+// Marathon doesn't know by start time
+type byInstanceOrder struct {
+	tasks    []*state.Task
+	marathon map[string]*marathonTask
+}
+
+func (o *byInstanceOrder) Len() int      { return len(o.tasks) }
+func (o *byInstanceOrder) Swap(i, j int) { o.tasks[i], o.tasks[j] = o.tasks[j], o.tasks[i] }
+func (o *byInstanceOrder) Less(i, j int) bool {
+	mi, oki := o.marathon[o.tasks[i].ID]
+	mj, okj := o.marathon[o.tasks[j].ID]
+	if oki != okj {
+		return oki
+	}
+	if oki && mi.index != mj.index {
+		return mi.index < mj.index
+	}
+
+	si, sj := startTime(o.tasks[i]), startTime(o.tasks[j])
+	if si != sj {
+		return si < sj
+	}
+	return o.tasks[i].ID < o.tasks[j].ID
+}
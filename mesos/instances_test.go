@@ -0,0 +1,137 @@
+package mesos
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/mesos-utility/mesos-consul/state"
+
+	"github.com/mesos/mesos-go/upid"
+)
+
+func TestAssignInstances(t *testing.T) {
+	task := func(id string, start float64, labels ...state.Label) state.Task {
+		return state.Task{
+			ID:       id,
+			Name:     "kafka",
+			SlaveID:  "s1",
+			State:    "TASK_RUNNING",
+			Labels:   labels,
+			Statuses: []state.Status{{State: "TASK_RUNNING", Timestamp: start}},
+		}
+	}
+
+	sj := state.State{Frameworks: []state.Framework{{Name: "marathon", Tasks: []state.Task{
+		task("c", 3),
+		task("a", 1),
+		task("b", 2, state.Label{Key: "consul_instance", Value: "0"}),
+	}}}}
+
+	m := &Mesos{
+		Registry:         newFakeRegistry(),
+		Agents:           map[string]string{"s1": "10.0.0.1"},
+		RegistrationMode: "all",
+		InstanceIndex:    true,
+		InstanceLabel:    "consul_instance",
+	}
+	m.assignInstances(sj)
+
+	for id, want := range map[string]int{"b": 0, "a": 1, "c": 2} {
+		if i, ok := m.instances[id]; !ok || i != want {
+			t.Errorf("task %s: expected index %d, got %d", id, want, i)
+		}
+	}
+
+	// The replacement of a lost task takes over its index
+	sj.Frameworks[0].Tasks[1] = task("d", 4)
+	m.assignInstances(sj)
+	if m.instances["d"] != 1 || m.instances["c"] != 2 {
+		t.Errorf("unexpected indexes %v", m.instances)
+	}
+
+	if tags := m.instanceTags(&sj.Frameworks[0].Tasks[0]); len(tags) != 1 || tags[0] != "2" {
+		t.Errorf("unexpected instance tags %v", tags)
+	}
+}
+
+func instanceState(starts map[string]float64) state.State {
+	pid, _ := upid.Parse("slave(1)@10.0.0.1:5051")
+
+	sj := state.State{
+		Leader: "master@10.0.0.1:5050",
+		Slaves: []state.Slave{{ID: "s1", Hostname: "a.example.com", PID: state.PID{UPID: pid}}},
+	}
+
+	fw := state.Framework{Name: "marathon"}
+	for _, id := range []string{"a", "b", "c"} {
+		fw.Tasks = append(fw.Tasks, state.Task{
+			ID:          id,
+			Name:        "kafka",
+			SlaveID:     "s1",
+			FrameworkID: "f1",
+			State:       "TASK_RUNNING",
+			Resources:   state.Resources{PortRanges: fmt.Sprintf("[%d-%d]", 31000+int(id[0]), 31000+int(id[0]))},
+			Statuses:    []state.Status{{State: "TASK_RUNNING", Timestamp: starts[id]}},
+		})
+	}
+	sj.Frameworks = append(sj.Frameworks, fw)
+
+	return sj
+}
+
+func instanceMesos(reg *fakeRegistry) *Mesos {
+	return &Mesos{
+		Registry:         reg,
+		Maintenance:      "off",
+		RegistrationMode: "all",
+		IpOrder:          []string{"host"},
+		ServiceName:      "mesos",
+		InstanceIndex:    true,
+		InstanceLabel:    "consul_instance",
+	}
+}
+
+func TestAssignInstances_Restart(t *testing.T) {
+	reg := newFakeRegistry()
+
+	m := instanceMesos(reg)
+	m.parseState(instanceState(map[string]float64{"a": 1, "b": 2, "c": 3}))
+	for id, want := range map[string]int{"a": 0, "b": 1, "c": 2} {
+		if i := m.instances[id]; i != want {
+			t.Fatalf("task %s: expected index %d, got %d", id, want, i)
+		}
+	}
+
+	// After a restart, the indexes registered in Consul are kept even
+	// though the start times would order the tasks differently
+	restarted := instanceMesos(reg)
+	restarted.parseState(instanceState(map[string]float64{"a": 3, "b": 2, "c": 1}))
+	if !reflect.DeepEqual(restarted.instances, m.instances) {
+		t.Errorf("indexes changed across a restart: %v, was %v", restarted.instances, m.instances)
+	}
+
+	// Without registrations, they're assigned again
+	fresh := instanceMesos(newFakeRegistry())
+	fresh.parseState(instanceState(map[string]float64{"a": 3, "b": 2, "c": 1}))
+	if want := map[string]int{"c": 0, "b": 1, "a": 2}; !reflect.DeepEqual(fresh.instances, want) {
+		t.Errorf("got indexes %v, want %v", fresh.instances, want)
+	}
+}
+
+func TestAssignInstances_MarathonOrder(t *testing.T) {
+	m := instanceMesos(newFakeRegistry())
+	m.Agents = map[string]string{"s1": "10.0.0.1"}
+	m.instances = make(map[string]int)
+
+	// Marathon lists c then a, b is unknown to it
+	m.marathonTasks = map[string]*marathonTask{
+		"c": {ID: "c", AppID: "/kafka", index: 0},
+		"a": {ID: "a", AppID: "/kafka", index: 1},
+	}
+
+	m.assignInstances(instanceState(map[string]float64{"a": 1, "b": 2, "c": 3}))
+	if want := map[string]int{"c": 0, "a": 1, "b": 2}; !reflect.DeepEqual(m.instances, want) {
+		t.Errorf("got indexes %v, want %v", m.instances, want)
+	}
+}
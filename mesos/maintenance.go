@@ -0,0 +1,156 @@
+package mesos
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mesos-utility/mesos-consul/state"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// loadMaintenance()
+//   Fetch the maintenance schedule and status from the master and
+//   return the reason of the maintenance of the agents, by agent ID
+//
+func (m *Mesos) loadMaintenance(sj state.State) (map[string]string, error) {
+	var schedule state.MaintenanceSchedule
+	var status state.MaintenanceStatus
+
+	leader := strings.Split(sj.Leader, "@")
+	if len(leader) != 2 {
+		return nil, fmt.Errorf("invalid Mesos leader '%s'", sj.Leader)
+	}
+
+	client := &http.Client{Timeout: m.AgentPollTimeout}
+	base := "http://" + leader[1]
+
+	if err := getJSON(client, base+"/maintenance/schedule", &schedule); err != nil {
+		return nil, err
+	}
+	if err := getJSON(client, base+"/maintenance/status", &status); err != nil {
+		return nil, err
+	}
+
+	return maintenanceReasons(sj.Slaves, schedule, status, time.Now()), nil
+}
+
+// maintenanceReasons()
+//   Return the reason of the maintenance of the agents that are down, or
+//   draining within their unavailability window, by agent ID
+//
+func maintenanceReasons(slaves []state.Slave, schedule state.MaintenanceSchedule, status state.MaintenanceStatus, now time.Time) map[string]string {
+	windows := make(map[state.MachineID]state.Unavailability)
+	for _, w := range schedule.Windows {
+		for _, id := range w.MachineIDs {
+			windows[id] = w.Unavailability
+		}
+	}
+
+	machines := make(map[state.MachineID]string)
+	for _, d := range status.DrainingMachines {
+		u, ok := windows[d.ID]
+		if !ok {
+			continue
+		}
+
+		start := time.Unix(0, u.Start.Nanoseconds)
+		if now.Before(start) {
+			continue
+		}
+
+		if u.Duration == nil {
+			machines[d.ID] = fmt.Sprintf("Mesos maintenance since %s", start.UTC().Format(time.RFC3339))
+		} else if end := start.Add(time.Duration(u.Duration.Nanoseconds)); now.Before(end) {
+			machines[d.ID] = fmt.Sprintf("Mesos maintenance until %s", end.UTC().Format(time.RFC3339))
+		}
+	}
+	for _, id := range status.DownMachines {
+		machines[id] = "Mesos agent down for maintenance"
+	}
+
+	reasons := make(map[string]string)
+	for _, s := range slaves {
+		ip := ""
+		if s.PID.UPID != nil {
+			ip = s.PID.Host
+		}
+
+		for id, reason := range machines {
+			if (id.Hostname != "" && id.Hostname == s.Hostname) || (id.IP != "" && id.IP == ip) {
+				reasons[s.ID] = reason
+			}
+		}
+	}
+
+	return reasons
+}
+
+// taskMaintenance()
+//   Return the maintenance reason set by the consul_maintenance label of
+//   the task
+//
+func taskMaintenance(t *state.Task) string {
+	switch reason := t.Label("consul_maintenance"); reason {
+	case "", "false":
+		return ""
+	case "true":
+		return "Maintenance requested by task label"
+	default:
+		return reason
+	}
+}
+
+// syncMaintenance()
+//   Put the services of the tasks asking for it, and the Consul agents or
+//   the services of the agents in Mesos maintenance, into Consul
+//   maintenance mode. Nothing changes when one of the sources can't be
+//   read, so that no maintenance is cleared by mistake.
+//
+func (m *Mesos) syncMaintenance(sj state.State, services map[string][]string) {
+	nodeReasons := make(map[string]string)
+	serviceReasons := make(map[string]string)
+
+	if m.Maintenance != "off" {
+		reasons, err := m.loadMaintenance(sj)
+		if err != nil {
+			log.Warn("Unable to load the maintenance status: ", err)
+			return
+		}
+
+		for id, reason := range reasons {
+			log.Debugf("Agent %s in maintenance: %s", id, reason)
+
+			switch m.Maintenance {
+			case "node":
+				if agent, ok := m.consulAgents[id]; ok {
+					nodeReasons[agent] = reason
+				}
+			case "service":
+				for _, sid := range services[id] {
+					serviceReasons[sid] = reason
+				}
+			}
+		}
+	}
+
+	// Maintenances asked for by the tasks override the ones of their agent
+	for _, p := range m.partitions {
+		for id, reason := range p.maintenance {
+			serviceReasons[id] = reason
+		}
+	}
+
+	keys, err := m.Registry.MaintenanceKeys(m.masterAgent(m.getLeader().Ip))
+	if err != nil {
+		log.Warn("Unable to load the maintenance keys: ", err)
+		return
+	}
+	for id, reason := range keys {
+		serviceReasons[id] = reason
+	}
+
+	m.Registry.Maintenance(nodeReasons, serviceReasons)
+}
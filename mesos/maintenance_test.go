@@ -0,0 +1,238 @@
+package mesos
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mesos-utility/mesos-consul/state"
+
+	"github.com/mesos/mesos-go/upid"
+)
+
+func TestMaintenanceReasons(t *testing.T) {
+	now := time.Unix(1000, 0)
+	hour := state.Nanoseconds{Nanoseconds: int64(time.Hour)}
+
+	slaves := []state.Slave{
+		{ID: "active", Hostname: "a.example.com"},
+		{ID: "scheduled", Hostname: "b.example.com"},
+		{ID: "over", Hostname: "c.example.com"},
+		{ID: "down", Hostname: "d.example.com"},
+		{ID: "other", Hostname: "e.example.com"},
+	}
+
+	window := func(hostname string, start time.Time) state.MaintenanceWindow {
+		return state.MaintenanceWindow{
+			MachineIDs: []state.MachineID{{Hostname: hostname}},
+			Unavailability: state.Unavailability{
+				Start:    state.Nanoseconds{Nanoseconds: start.UnixNano()},
+				Duration: &hour,
+			},
+		}
+	}
+
+	schedule := state.MaintenanceSchedule{
+		Windows: []state.MaintenanceWindow{
+			window("a.example.com", now.Add(-time.Minute)),
+			window("b.example.com", now.Add(time.Minute)),
+			window("c.example.com", now.Add(-2*time.Hour)),
+			window("d.example.com", now.Add(-time.Minute)),
+		},
+	}
+
+	status := state.MaintenanceStatus{
+		DrainingMachines: []state.DrainingMachine{
+			{ID: state.MachineID{Hostname: "a.example.com"}},
+			{ID: state.MachineID{Hostname: "b.example.com"}},
+			{ID: state.MachineID{Hostname: "c.example.com"}},
+		},
+		DownMachines: []state.MachineID{{Hostname: "d.example.com"}},
+	}
+
+	reasons := maintenanceReasons(slaves, schedule, status, now)
+
+	for _, id := range []string{"active", "down"} {
+		if _, ok := reasons[id]; !ok {
+			t.Errorf("Agent %s should be in maintenance", id)
+		}
+	}
+	for _, id := range []string{"scheduled", "over", "other"} {
+		if r, ok := reasons[id]; ok {
+			t.Errorf("Agent %s shouldn't be in maintenance: %s", id, r)
+		}
+	}
+}
+
+// maintenanceServer serves a schedule putting the agent with the hostname
+// into maintenance
+func maintenanceServer(hostname string) *httptest.Server {
+	hour := state.Nanoseconds{Nanoseconds: int64(time.Hour)}
+	id := state.MachineID{Hostname: hostname}
+
+	schedule := state.MaintenanceSchedule{Windows: []state.MaintenanceWindow{{
+		MachineIDs: []state.MachineID{id},
+		Unavailability: state.Unavailability{
+			Start:    state.Nanoseconds{Nanoseconds: time.Now().Add(-time.Minute).UnixNano()},
+			Duration: &hour,
+		},
+	}}}
+	status := state.MaintenanceStatus{DrainingMachines: []state.DrainingMachine{{ID: id}}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/maintenance/schedule", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(schedule)
+	})
+	mux.HandleFunc("/maintenance/status", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(status)
+	})
+
+	return httptest.NewServer(mux)
+}
+
+func maintenanceState(leader string) state.State {
+	pid, _ := upid.Parse("slave(1)@10.0.0.1:5051")
+
+	return state.State{
+		Leader: "master@" + leader,
+		Slaves: []state.Slave{{ID: "s1", Hostname: "a.example.com", PID: state.PID{UPID: pid}}},
+		Frameworks: []state.Framework{{Name: "marathon", Tasks: []state.Task{{
+			ID:          "web.1",
+			Name:        "web",
+			SlaveID:     "s1",
+			FrameworkID: "f1",
+			State:       "TASK_RUNNING",
+		}}}},
+	}
+}
+
+func TestSyncMaintenance_UnchangedPartition(t *testing.T) {
+	srv := maintenanceServer("a.example.com")
+	defer srv.Close()
+
+	reg := newFakeRegistry()
+	m := &Mesos{
+		Registry:         reg,
+		Maintenance:      "service",
+		RegistrationMode: "all",
+		IpOrder:          []string{"host"},
+		ServiceName:      "mesos",
+	}
+	leader := strings.TrimPrefix(srv.URL, "http://")
+
+	for sync := 1; sync <= 2; sync++ {
+		m.parseState(maintenanceState(leader))
+
+		if len(reg.serviceMaintenance) != 2 {
+			t.Fatalf("sync %d: expected the agent and task services in maintenance, got %v", sync, reg.serviceMaintenance)
+		}
+	}
+
+	if len(m.partitions) != 1 {
+		t.Fatalf("expected a single partition, got %d", len(m.partitions))
+	}
+}
+
+func TestLoadMaintenance_InvalidLeader(t *testing.T) {
+	m := &Mesos{}
+
+	for _, leader := range []string{"", "10.0.0.1:5050"} {
+		if _, err := m.loadMaintenance(state.State{Leader: leader}); err == nil {
+			t.Errorf("leader %q: expected an error", leader)
+		}
+	}
+
+	// Without maintenance status, the maintenances are left as they are
+	reg := newFakeRegistry()
+	m = &Mesos{Registry: reg, Maintenance: "service"}
+	m.syncMaintenance(state.State{Leader: "master"}, nil)
+	if reg.serviceMaintenance != nil || reg.nodeMaintenance != nil {
+		t.Errorf("maintenance changed without maintenance status: %v %v", reg.nodeMaintenance, reg.serviceMaintenance)
+	}
+}
+
+func TestTaskMaintenance(t *testing.T) {
+	for value, want := range map[string]string{
+		"":            "",
+		"false":       "",
+		"true":        "Maintenance requested by task label",
+		"new release": "new release",
+	} {
+		task := &state.Task{}
+		if value != "" {
+			task.Labels = []state.Label{{Key: "consul_maintenance", Value: value}}
+		}
+
+		if got := taskMaintenance(task); got != want {
+			t.Errorf("label %q: got reason %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestSyncMaintenance_Sources(t *testing.T) {
+	reg := newFakeRegistry()
+	m := &Mesos{
+		Registry:         reg,
+		Maintenance:      "off",
+		RegistrationMode: "all",
+		IpOrder:          []string{"host"},
+		ServiceName:      "mesos",
+	}
+
+	sj := maintenanceState("10.0.0.1:5050")
+	sj.Frameworks[0].Tasks[0].Labels = []state.Label{{Key: "consul_maintenance", Value: "draining"}}
+	sj.Frameworks[0].Tasks = append(sj.Frameworks[0].Tasks, state.Task{
+		ID:          "api.1",
+		Name:        "api",
+		SlaveID:     "s1",
+		FrameworkID: "f1",
+		State:       "TASK_RUNNING",
+	})
+
+	m.parseState(sj)
+
+	var web, api string
+	for id, s := range reg.services {
+		switch s.Name {
+		case "web":
+			web = id
+		case "api":
+			api = id
+		}
+	}
+	if web == "" || api == "" {
+		t.Fatalf("expected the web and api services, got %v", reg.services)
+	}
+
+	// The label puts the services of the task in maintenance
+	if want := map[string]string{web: "draining"}; !reflect.DeepEqual(reg.serviceMaintenance, want) {
+		t.Errorf("label: got %v, want %v", reg.serviceMaintenance, want)
+	}
+
+	// The KV keys add to the labels and override them
+	reg.keys = map[string]string{web: "from kv", api: "kv only"}
+	m.parseState(sj)
+	if want := map[string]string{web: "from kv", api: "kv only"}; !reflect.DeepEqual(reg.serviceMaintenance, want) {
+		t.Errorf("kv: got %v, want %v", reg.serviceMaintenance, want)
+	}
+
+	// Unreadable keys leave the maintenances as they are
+	reg.keys, reg.keysErr = nil, errors.New("connection refused")
+	sj.Frameworks[0].Tasks[0].Labels = nil
+	m.parseState(sj)
+	if want := map[string]string{web: "from kv", api: "kv only"}; !reflect.DeepEqual(reg.serviceMaintenance, want) {
+		t.Errorf("kv error: got %v, want %v", reg.serviceMaintenance, want)
+	}
+
+	// Once the label and keys are gone, the maintenances are cleared
+	reg.keysErr = nil
+	m.parseState(sj)
+	if len(reg.serviceMaintenance) != 0 {
+		t.Errorf("got %v after the label and keys were removed", reg.serviceMaintenance)
+	}
+}
@@ -0,0 +1,267 @@
+package mesos
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mesos-utility/mesos-consul/config"
+	"github.com/mesos-utility/mesos-consul/registry"
+	"github.com/mesos-utility/mesos-consul/state"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// marathonTask holds a task as defined in the /v2/tasks Marathon HTTP endpoint.
+type marathonTask struct {
+	ID      string `json:"id"`
+	AppID   string `json:"appId"`
+	Version string `json:"version"`
+	Ports   []int  `json:"ports"`
+
+	// Marathon instance the task was found on, and position of the task
+	// among the tasks of its app
+	instance string
+	index    int
+}
+
+type marathonTasks struct {
+	Tasks []marathonTask `json:"tasks"`
+}
+
+// marathonHealthCheck holds a health check as defined in the
+// /v2/apps/<app>/versions/<version> Marathon HTTP endpoint.
+type marathonHealthCheck struct {
+	Protocol        string `json:"protocol"`
+	Path            string `json:"path"`
+	PortIndex       int    `json:"portIndex"`
+	Port            int    `json:"port"`
+	IntervalSeconds int    `json:"intervalSeconds"`
+	TimeoutSeconds  int    `json:"timeoutSeconds"`
+}
+
+type marathonApp struct {
+	ID           string                `json:"id"`
+	Version      string                `json:"version"`
+	HealthChecks []marathonHealthCheck `json:"healthChecks"`
+}
+
+// basicAuthTransport adds the Marathon credentials to every request
+type basicAuthTransport struct {
+	username string
+	password string
+	rt       http.RoundTripper
+}
+
+func (t *basicAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.SetBasicAuth(t.username, t.password)
+
+	return t.rt.RoundTrip(r)
+}
+
+// marathonTransport()
+//   Build the HTTP transport used to talk to Marathon, with its TLS and
+//   authentication settings. The event streams share it, so it only
+//   limits the time to connect and to get the response headers.
+//
+func marathonTransport(c *config.Config) http.RoundTripper {
+	t := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   c.MarathonTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: c.MarathonTimeout,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: !c.MarathonSSLVerify,
+		},
+	}
+
+	if c.MarathonCACert != "" {
+		pem, err := ioutil.ReadFile(c.MarathonCACert)
+		if err != nil {
+			log.WithField("file", c.MarathonCACert).Fatal("Unable to read the Marathon CA certificate: ", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			log.WithField("file", c.MarathonCACert).Fatal("No certificate found in the Marathon CA certificate file")
+		}
+		t.TLSClientConfig.RootCAs = pool
+	}
+
+	if c.MarathonAuth == "" {
+		return t
+	}
+
+	auth := strings.SplitN(c.MarathonAuth, ":", 2)
+	if len(auth) < 2 {
+		auth = append(auth, "")
+	}
+
+	return &basicAuthTransport{username: auth[0], password: auth[1], rt: t}
+}
+
+// loadMarathon()
+//   Fetch the tasks of every Marathon instance, and the definitions of
+//   their apps that aren't cached yet. Definitions are cached by app and
+//   version, so a definition is fetched once per deployment. The tasks
+//   of an instance that can't be reached are kept as they were.
+//
+func (m *Mesos) loadMarathon() {
+	if len(m.Marathon) == 0 {
+		return
+	}
+
+	client := &http.Client{Transport: m.marathonTransport, Timeout: m.marathonTimeout}
+
+	byID := make(map[string]*marathonTask, len(m.marathonTasks))
+	apps := make(map[string]*marathonApp)
+	for _, instance := range m.Marathon {
+		var tasks marathonTasks
+		if err := getJSON(client, instance+"/v2/tasks", &tasks); err != nil {
+			log.Warnf("Unable to load the tasks of Marathon %s: %s", instance, err)
+
+			for id, t := range m.marathonTasks {
+				if t.instance == instance {
+					byID[id] = t
+					apps[marathonKey(t)] = m.marathonApps[marathonKey(t)]
+				}
+			}
+			continue
+		}
+
+		positions := make(map[string]int)
+		for i := range tasks.Tasks {
+			t := &tasks.Tasks[i]
+			t.instance = instance
+			t.index = positions[t.AppID]
+			positions[t.AppID]++
+			key := marathonKey(t)
+
+			if _, ok := apps[key]; !ok {
+				app, ok := m.marathonApps[key]
+				if !ok {
+					app = new(marathonApp)
+					url := fmt.Sprintf("%s/v2/apps%s/versions/%s", instance, t.AppID, t.Version)
+					if err := getJSON(client, url, app); err != nil {
+						log.Warnf("Unable to load Marathon app %s version %s: %s", t.AppID, t.Version, err)
+						continue
+					}
+					stats.Add("marathon_app_fetches", 1)
+				}
+				apps[key] = app
+			}
+			byID[t.ID] = t
+		}
+	}
+
+	m.marathonTasks = byID
+	m.marathonApps = apps
+}
+
+func marathonKey(t *marathonTask) string {
+	return t.instance + t.AppID + "@" + t.Version
+}
+
+// marathonVersion()
+//   Return the app and version of the Marathon task, if known
+//
+func (m *Mesos) marathonVersion(t *state.Task) string {
+	mt, ok := m.marathonTasks[t.ID]
+	if !ok {
+		return ""
+	}
+
+	return marathonKey(mt)
+}
+
+// marathonCheck()
+//   Convert the Marathon health check of the port of the service into a
+//   Consul check
+//
+func (m *Mesos) marathonCheck(t *state.Task, cv *CheckVar) *registry.Check {
+	mt, ok := m.marathonTasks[t.ID]
+	if !ok || cv.Port == "" {
+		return nil
+	}
+	app, ok := m.marathonApps[m.marathonVersion(t)]
+	if !ok {
+		return nil
+	}
+
+	port := toPort(cv.Port)
+	for _, hc := range app.HealthChecks {
+		hcPort := hc.Port
+		if hcPort == 0 && hc.PortIndex < len(mt.Ports) {
+			hcPort = mt.Ports[hc.PortIndex]
+		}
+		if hcPort != port {
+			continue
+		}
+
+		c := registry.DefaultCheck()
+		if hc.IntervalSeconds > 0 {
+			c.Interval = fmt.Sprintf("%ds", hc.IntervalSeconds)
+		}
+		if hc.TimeoutSeconds > 0 {
+			c.Timeout = fmt.Sprintf("%ds", hc.TimeoutSeconds)
+		}
+
+		switch strings.TrimPrefix(strings.ToUpper(hc.Protocol), "MESOS_") {
+		case "HTTP", "":
+			c.HTTP = fmt.Sprintf("http://%s:%d%s", cv.Host, port, hc.Path)
+		case "HTTPS":
+			c.HTTP = fmt.Sprintf("https://%s:%d%s", cv.Host, port, hc.Path)
+		case "TCP":
+			c.TCP = fmt.Sprintf("%s:%d", cv.Host, port)
+		default:
+			continue
+		}
+
+		return c
+	}
+
+	return nil
+}
+
+// taskApp()
+//   Return the Marathon app of the task, from the Marathon tasks or from
+//   the task ID
+//
+func (m *Mesos) taskApp(taskID string) string {
+	if mt, ok := m.marathonTasks[taskID]; ok {
+		return mt.AppID
+	}
+
+	return marathonAppID(taskID)
+}
+
+// marathonAppID()
+//   Derive the app ID from the ID of a task launched by Marathon, in the
+//   <app with / replaced by _>.<uuid> form
+//
+func marathonAppID(taskID string) string {
+	id := taskID
+	if i := strings.Index(id, ".instance-"); i >= 0 {
+		id = id[:i]
+	} else if i := strings.LastIndex(id, "."); i >= 0 {
+		id = id[:i]
+	} else {
+		return ""
+	}
+
+	return "/" + strings.Replace(id, "_", "/", -1)
+}
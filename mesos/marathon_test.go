@@ -0,0 +1,52 @@
+package mesos
+
+import (
+	"testing"
+
+	"github.com/mesos-utility/mesos-consul/state"
+)
+
+func TestMarathonCheck(t *testing.T) {
+	m := &Mesos{
+		marathonTasks: map[string]*marathonTask{
+			"web.1": {ID: "web.1", AppID: "/web", Version: "v1", Ports: []int{31000, 31001}, instance: "http://marathon"},
+		},
+		marathonApps: map[string]*marathonApp{
+			"http://marathon/web@v1": {HealthChecks: []marathonHealthCheck{
+				{Protocol: "MESOS_HTTP", Path: "/health", PortIndex: 1, IntervalSeconds: 5, TimeoutSeconds: 2},
+			}},
+		},
+	}
+	task := &state.Task{ID: "web.1"}
+
+	if c := m.marathonCheck(task, &CheckVar{Host: "h", Port: "31000"}); c != nil {
+		t.Errorf("port 31000 shouldn't have a check: %+v", c)
+	}
+
+	c := m.marathonCheck(task, &CheckVar{Host: "h", Port: "31001"})
+	if c == nil || c.HTTP != "http://h:31001/health" || c.Interval != "5s" || c.Timeout != "2s" {
+		t.Errorf("unexpected check for port 31001: %+v", c)
+	}
+
+	task.Labels = []state.Label{{Key: "check_http_port1", Value: "http://{host}:{port}/ping"}}
+	c, _ = getCheck(task, &CheckVar{Host: "h", Port: "31001", PortIndex: 1}, c)
+	if c.HTTP != "http://h:31001/ping" {
+		t.Errorf("labels should override the Marathon check: %+v", c)
+	}
+}
+
+func TestMarathonAppID(t *testing.T) {
+	tests := map[string]string{
+		"web.5b2a2f1e-0b8a-11e7-93ae-92361f002671":                    "/web",
+		"group_web.5b2a2f1e-0b8a-11e7-93ae-92361f002671":              "/group/web",
+		"my.web.marathon-5b2a2f1e-0b8a-11e7-93ae-92361f002671":        "/my.web",
+		"pod.instance-5b2a2f1e-0b8a-11e7-93ae-92361f002671.container": "/pod",
+		"nodots": "",
+	}
+
+	for id, want := range tests {
+		if got := marathonAppID(id); got != want {
+			t.Errorf("marathonAppID(%q) = %q, want %q", id, got, want)
+		}
+	}
+}
@@ -8,10 +8,14 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
 
 	"github.com/mesos-utility/mesos-consul/config"
 	"github.com/mesos-utility/mesos-consul/consul"
 	"github.com/mesos-utility/mesos-consul/registry"
+	"github.com/mesos-utility/mesos-consul/rules"
 	"github.com/mesos-utility/mesos-consul/state"
 
 	consulapi "github.com/hashicorp/consul/api"
@@ -42,8 +46,92 @@ type Mesos struct {
 
 	Separator string
 
+	StateMode        string
+	Maintenance      string
+	AgentPollWorkers int
+	AgentPollTimeout time.Duration
+
 	ServiceName string
 	ServiceTags []string
+
+	// Tasks registered: all of them or the ones opting in with the
+	// registration label
+	RegistrationMode  string
+	registrationKey   string
+	registrationValue string
+	IgnoreVisibility  bool
+
+	// Labels turned into tags
+	TagLabelPrefix string
+	TagLabels      []string
+	DiscoveryTags  bool
+
+	// Sources of the task versions, and the tag and meta key they are
+	// exposed as
+	VersionSources []string
+	VersionTag     string
+	VersionMeta    string
+
+	// Add the container image to the tags
+	ContainerTags bool
+
+	// Re-register the tasks whose resources change
+	ResourceChanges bool
+
+	// Instance indexes of the tasks, by task ID
+	InstanceIndex bool
+	InstanceLabel string
+	instances     map[string]int
+
+	MesosHealth bool
+	healthTTL   string
+
+	// Environment variables the check labels may expand
+	checkEnv map[string]bool
+
+	// Marathon APIs, and the tasks and app definitions they returned
+	Marathon          []string
+	MarathonEvents    bool
+	marathonTransport http.RoundTripper
+	marathonTimeout   time.Duration
+	marathonTasks     map[string]*marathonTask
+	marathonApps      map[string]*marathonApp
+
+	// Apps changed according to the Marathon event streams, and the
+	// services of the apps synced since the last refresh
+	triggers chan map[string]bool
+	targeted map[string][]string
+
+	// Least time between a state load and the next one triggered by
+	// events, and the time of the last load in nanoseconds
+	EventsInterval time.Duration
+	lastLoad       int64
+
+	partitions map[string]*partition
+
+	// Consul agents of the Mesos agents, by agent ID, and masters, by IP
+	AgentDiscovery bool
+	agentTemplate  *template.Template
+	agentTable     map[string]agentMapping
+	consulAgents   map[string]string
+	masterAgents   map[string]string
+
+	// Attributes of the Mesos agents, by agent ID
+	slaveAttributes map[string]map[string]string
+
+	// Rules rewriting the task services
+	rules *rules.Engine
+
+	// Owners of the service names, and the names produced by several
+	// apps, guarded by Lock
+	NameCollisions string
+	nameOwners     map[string]identity
+	collisions     map[string][]identity
+
+	// Policy turning task names into service names, and the names it
+	// altered or rejected, guarded by Lock
+	names       namePolicy
+	nameChanges map[string]nameChange
 }
 
 func New(c *config.Config) *Mesos {
@@ -54,6 +142,25 @@ func New(c *config.Config) *Mesos {
 	}
 	m.Separator = c.Separator
 
+	switch c.StateMode {
+	case "master", "agents":
+	default:
+		log.Fatalf("Invalid state mode: '%v'", c.StateMode)
+	}
+	m.StateMode = c.StateMode
+	m.AgentPollWorkers = c.AgentPollWorkers
+	if m.AgentPollWorkers < 1 {
+		m.AgentPollWorkers = 1
+	}
+	m.AgentPollTimeout = c.AgentPollTimeout
+
+	switch c.Maintenance {
+	case "off", "node", "service":
+	default:
+		log.Fatalf("Invalid maintenance mode: '%v'", c.Maintenance)
+	}
+	m.Maintenance = c.Maintenance
+
 	if len(c.WhiteList) > 0 {
 		m.WhiteList = strings.Join(c.WhiteList, "|")
 		log.WithField("whitelist", m.WhiteList).Debug("Using whitelist regex")
@@ -86,6 +193,90 @@ func New(c *config.Config) *Mesos {
 
 	m.ServiceName = cleanName(c.ServiceName, c.Separator)
 
+	switch c.NameCollisions {
+	case "warn", "refuse", "prefix":
+	default:
+		log.Fatalf("Invalid name collision policy: '%v'", c.NameCollisions)
+	}
+	m.NameCollisions = c.NameCollisions
+	m.publishCollisions()
+
+	names, err := newNamePolicy(c.NameReplacement, c.NameMaxLength, c.NameTrim, c.NameStrict)
+	if err != nil {
+		log.Fatal("Invalid name policy: ", err)
+	}
+	m.names = names
+	m.publishNames()
+
+	switch c.RegistrationMode {
+	case "all", "opt-in":
+	default:
+		log.Fatalf("Invalid registration mode: '%v'", c.RegistrationMode)
+	}
+	m.RegistrationMode = c.RegistrationMode
+	label := strings.SplitN(c.RegistrationLabel, "=", 2)
+	m.registrationKey = label[0]
+	if len(label) > 1 {
+		m.registrationValue = label[1]
+	}
+	m.IgnoreVisibility = c.IgnoreVisibility
+
+	m.TagLabelPrefix = c.TagLabelPrefix
+	if c.TagLabels != "" {
+		m.TagLabels = strings.Split(c.TagLabels, ",")
+	}
+	m.DiscoveryTags = c.DiscoveryTags
+
+	sources, err := parseVersionSources(c.VersionSources)
+	if err != nil {
+		log.Fatal(err)
+	}
+	m.VersionSources = sources
+	m.VersionTag = c.VersionTag
+	m.VersionMeta = c.VersionMeta
+	m.ContainerTags = c.ContainerTags
+	m.ResourceChanges = c.ResourceChanges
+	m.InstanceIndex = c.InstanceIndex
+	m.InstanceLabel = c.InstanceLabel
+
+	engine, err := rules.Load(c.ConfigFile)
+	if err != nil {
+		log.WithField("config", c.ConfigFile).Fatal("Unable to load the rules: ", err)
+	}
+	m.rules = engine
+
+	// Let the TTL checks survive a couple of missed refreshes
+	m.MesosHealth = c.MesosHealth
+	m.healthTTL = (3 * c.Refresh).String()
+
+	m.checkEnv = make(map[string]bool)
+	for _, name := range strings.Split(c.CheckEnv, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			m.checkEnv[name] = true
+		}
+	}
+
+	for _, instance := range strings.Split(c.Marathon, ",") {
+		if instance = strings.TrimRight(strings.TrimSpace(instance), "/"); instance != "" {
+			m.Marathon = append(m.Marathon, instance)
+		}
+	}
+	m.marathonTransport = marathonTransport(c)
+	m.marathonTimeout = c.MarathonTimeout
+
+	m.MarathonEvents = c.MarathonEvents
+	m.EventsInterval = c.MarathonEventsInterval
+	if m.MarathonEvents {
+		if len(m.Marathon) == 0 {
+			log.Fatal("Marathon events need the Marathon API")
+		}
+		m.subscribeEvents()
+	}
+
+	m.AgentDiscovery = c.ConsulAgentDiscovery
+	m.agentTemplate = parseAgentTemplate(c.ConsulAgentTemplate)
+	m.agentTable = loadAgentTable(c.ConsulAgentTable)
+
 	m.Registry = consul.New()
 
 	if m.Registry == nil {
@@ -122,6 +313,9 @@ func (m *Mesos) Refresh() error {
 		return errors.New("Empty master")
 	}
 
+	m.mapAgents(sj)
+	m.loadMarathon()
+
 	if m.Registry.CacheCreate() {
 		m.LoadCache()
 	}
@@ -131,6 +325,74 @@ func (m *Mesos) Refresh() error {
 	return nil
 }
 
+// SyncApps()
+//   Sync the services of the Marathon apps right away, without waiting
+//   for the next refresh
+//
+func (m *Mesos) SyncApps(apps map[string]bool) error {
+	if m.partitions == nil {
+		return m.Refresh()
+	}
+
+	sj, err := m.loadState()
+	if err != nil {
+		log.Warn("loadState failed: ", err.Error())
+		return err
+	}
+
+	if sj.Leader == "" {
+		return errors.New("Empty master")
+	}
+
+	m.loadMarathon()
+	m.assignInstances(sj)
+
+	// Services of the apps, as of the last refresh or the last sync of
+	// the app
+	previous := make(map[string][]string)
+	for _, p := range m.partitions {
+		for id, ids := range p.tasks {
+			if app := m.taskApp(id); apps[app] {
+				previous[app] = append(previous[app], ids...)
+			}
+		}
+	}
+	for app := range apps {
+		if ids, ok := m.targeted[app]; ok {
+			previous[app] = ids
+		}
+		m.targeted[app] = []string{}
+	}
+
+	current := make(map[string]bool)
+	for _, g := range m.partitionTasks(sj) {
+		for _, task := range g.tasks {
+			app := m.taskApp(task.ID)
+			if !apps[app] {
+				continue
+			}
+
+			ids := m.registerTask(task, g.agent)
+			for _, id := range ids {
+				current[id] = true
+			}
+			m.targeted[app] = append(m.targeted[app], ids...)
+		}
+	}
+
+	var gone []string
+	for app := range apps {
+		for _, id := range previous[app] {
+			if !current[id] {
+				gone = append(gone, id)
+			}
+		}
+	}
+	m.Registry.DeregisterIDs(gone)
+
+	return nil
+}
+
 func (m *Mesos) loadState() (state.State, error) {
 	var err error
 	var sj state.State
@@ -152,16 +414,28 @@ func (m *Mesos) loadState() (state.State, error) {
 	log.Infof("Zookeeper leader: %s:%s", mh.Ip, mh.PortString)
 
 	log.Info("reloading from master ", mh.Ip)
-	sj, err = m.loadFromMaster(mh.Ip, mh.PortString)
+	sj, err = m.load(mh.Ip, mh.PortString)
 
 	if rip := leaderIP(sj.Leader); rip != mh.Ip {
 		log.Warn("master changed to ", rip)
-		sj, err = m.loadFromMaster(rip, mh.PortString)
+		sj, err = m.load(rip, mh.PortString)
+	}
+
+	if err == nil {
+		atomic.StoreInt64(&m.lastLoad, time.Now().UnixNano())
 	}
 
 	return sj, err
 }
 
+func (m *Mesos) load(ip string, port string) (state.State, error) {
+	if m.StateMode == "agents" {
+		return m.loadFromAgents(ip, port)
+	}
+
+	return m.loadFromMaster(ip, port)
+}
+
 func (m *Mesos) loadFromMaster(ip string, port string) (sj state.State, err error) {
 	url := "http://" + ip + ":" + port + "/master/state.json"
 
@@ -194,15 +468,65 @@ func (m *Mesos) parseState(sj state.State) {
 	m.RegisterHosts(sj)
 	log.Debug("Done running RegisterHosts")
 
-	for _, fw := range sj.Frameworks {
-		for _, task := range fw.Tasks {
-			agent, ok := m.Agents[task.SlaveID]
-			if ok && task.State == "TASK_RUNNING" {
-				task.SlaveIP = agent
-				m.registerTask(&task, agent)
+	m.detectCollisions(sj)
+	m.assignInstances(sj)
+
+	// Services of every agent, for the maintenance of the agents
+	services := make(map[string][]string)
+	for _, s := range sj.Slaves {
+		services[s.ID] = []string{m.agentServiceID(s)}
+	}
+
+	partitions := make(map[string]*partition)
+	for _, g := range m.partitionTasks(sj) {
+		fp := m.fingerprint(g)
+
+		stats.Add("partitions", 1)
+		stats.Add("tasks", int64(len(g.tasks)))
+
+		if p, ok := m.partitions[g.key]; ok && p.fingerprint == fp && m.isCached(p.ids) {
+			log.Debugf("Partition %s unchanged. Skipping", g.key)
+			for _, id := range p.ids {
+				m.Registry.CacheMark(id)
+			}
+
+			stats.Add("partitions_skipped", 1)
+			stats.Add("tasks_skipped", int64(len(g.tasks)))
+			partitions[g.key] = p
+			services[g.slave] = append(services[g.slave], p.ids...)
+			continue
+		}
+
+		p := &partition{
+			fingerprint: fp,
+			maintenance: make(map[string]string),
+			tasks:       make(map[string][]string),
+		}
+		for _, task := range g.tasks {
+			ids := m.registerTask(task, g.agent)
+			p.tasks[task.ID] = ids
+			if reason := taskMaintenance(task); reason != "" {
+				for _, id := range ids {
+					p.maintenance[id] = reason
+				}
 			}
+			p.ids = append(p.ids, ids...)
 		}
+		partitions[g.key] = p
+		services[g.slave] = append(services[g.slave], p.ids...)
 	}
+	m.partitions = partitions
+	m.targeted = make(map[string][]string)
+
+	// Keep the registrations of the agents that couldn't be polled
+	for _, s := range sj.Unreachable {
+		if agent, ok := m.consulAgents[s.ID]; ok {
+			log.Infof("Keeping registrations of unreachable agent %s", s.ID)
+			m.Registry.CacheMarkAgent(agent)
+		}
+	}
+
+	m.syncMaintenance(sj, services)
 
 	// Remove completed tasks
 	m.Registry.Deregister()
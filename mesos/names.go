@@ -0,0 +1,206 @@
+package mesos
+
+import (
+	"expvar"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Task names go through cleanName semantics first: characters other than
+// letters, digits, '-' and '_' become the replacement character, and '_'
+// becomes the group separator. The policy then trims, collapses and
+// shortens the result so it stays usable in *.service.consul lookups, or
+// rejects it outright in strict mode.
+
+const maxLabelLength = 63
+
+var (
+	nameRegex     = regexp.MustCompile("[^\\w-]|_")
+	dnsLabelRegex = regexp.MustCompile("^[a-z0-9]([a-z0-9-]*[a-z0-9])?$")
+)
+
+type namePolicy struct {
+	replacement string
+	maxLength   int
+	trim        bool
+	strict      bool
+
+	// Runs of dashes and replacement characters collapsed when trimming
+	runs *regexp.Regexp
+}
+
+// newNamePolicy()
+//   Check the name settings and build the policy
+//
+func newNamePolicy(replacement string, maxLength int, trim, strict bool) (namePolicy, error) {
+	p := namePolicy{replacement: replacement, maxLength: maxLength, trim: trim, strict: strict}
+
+	// A dot would split the name into a tag and a service in DNS lookups
+	if len(replacement) != 1 || !strings.Contains("-_", replacement) {
+		return p, fmt.Errorf("invalid replacement character %q", replacement)
+	}
+	if maxLength != 0 && maxLength < 10 {
+		return p, fmt.Errorf("maximum name length %d leaves no room for the hash suffix", maxLength)
+	}
+	p.runs = regexp.MustCompile("[" + regexp.QuoteMeta("-"+replacement) + "]{2,}")
+
+	return p, nil
+}
+
+// nameChange is reported for every task name altered or rejected by the
+// policy
+type nameChange struct {
+	Name  string `json:"name,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// sanitizeName()
+//   Turn a task name into a service name according to the name policy
+//
+func (m *Mesos) sanitizeName(name string) (string, error) {
+	p := m.names
+	repl := p.replacement
+	if repl == "" {
+		repl = "-"
+	}
+
+	s := strings.ToLower(nameRegex.ReplaceAllStringFunc(name, func(c string) string {
+		if c == "_" {
+			return m.Separator
+		}
+		return repl
+	}))
+
+	if p.strict {
+		if err := validName(s, p.maxLength); err != nil {
+			return "", err
+		}
+		return s, nil
+	}
+
+	if p.trim {
+		s = p.trimName(s, repl)
+	}
+
+	if p.maxLength > 0 && len(s) > p.maxLength {
+		suffix := hashSuffix(name)
+
+		s = s[:p.maxLength-len(suffix)-1]
+		if p.trim {
+			s = strings.TrimRight(s, "-"+repl)
+		}
+		s = s + "-" + suffix
+	}
+
+	return s, nil
+}
+
+// hashSuffix()
+//   Stable suffix telling apart the names cut to the same prefix
+//
+func hashSuffix(name string) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// trimName()
+//   Collapse the runs of dashes and replacement characters, and trim them
+//   from both ends of the name
+//
+func (p *namePolicy) trimName(s, repl string) string {
+	s = p.runs.ReplaceAllStringFunc(s, func(r string) string {
+		return r[:1]
+	})
+
+	return strings.Trim(s, "-"+repl)
+}
+
+// validName()
+//   Check that every dot separated part of the name is a valid DNS label,
+//   and that the name fits in the maximum length
+//
+func validName(s string, maxLength int) error {
+	if maxLength > 0 && len(s) > maxLength {
+		return fmt.Errorf("%q is longer than %d characters", s, maxLength)
+	}
+
+	for _, label := range strings.Split(s, ".") {
+		if len(label) > maxLabelLength {
+			return fmt.Errorf("%q has a label longer than %d characters", s, maxLabelLength)
+		}
+		if !dnsLabelRegex.MatchString(label) {
+			return fmt.Errorf("%q is not a valid DNS name", s)
+		}
+	}
+
+	return nil
+}
+
+// nameReport()
+//   Report of the task names altered or rejected by the name policy,
+//   published on /debug/vars
+//
+func (m *Mesos) nameReport() interface{} {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+
+	report := make(map[string]nameChange, len(m.nameChanges))
+	for raw, c := range m.nameChanges {
+		report[raw] = c
+	}
+
+	return report
+}
+
+// recordName()
+//   Remember the outcome of the name policy for a task name when it
+//   differs from the plain cleaned name, and log it the first time
+//
+func (m *Mesos) recordName(changes map[string]nameChange, raw, name string, err error) {
+	var c nameChange
+	if err != nil {
+		c.Error = err.Error()
+	} else if name != cleanName(raw, m.Separator) {
+		c.Name = name
+	} else {
+		return
+	}
+
+	if old, ok := m.nameChanges[raw]; !ok || old != c {
+		if err != nil {
+			log.Warnf("Task name %s rejected: %s", raw, c.Error)
+		} else {
+			log.Infof("Task name %s registered as %s", raw, name)
+		}
+	}
+	changes[raw] = c
+}
+
+func (m *Mesos) publishNames() {
+	expvar.Publish("names", expvar.Func(m.nameReport))
+	stats.Set("names_altered", expvar.Func(func() interface{} {
+		return m.countNames(false)
+	}))
+	stats.Set("names_rejected", expvar.Func(func() interface{} {
+		return m.countNames(true)
+	}))
+}
+
+func (m *Mesos) countNames(rejected bool) int {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+
+	n := 0
+	for _, c := range m.nameChanges {
+		if (c.Error != "") == rejected {
+			n++
+		}
+	}
+
+	return n
+}
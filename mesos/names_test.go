@@ -0,0 +1,57 @@
+package mesos
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeName(t *testing.T) {
+	long := strings.Repeat("a", 70)
+
+	for _, tc := range []struct {
+		maxLength int
+		trim      bool
+		strict    bool
+		in, out   string
+		err       bool
+	}{
+		{in: "/Web/API.dev", out: "-web-api-dev"},
+		{trim: true, in: "/Web//API.dev-", out: "web-api-dev"},
+		{maxLength: 20, in: "abcdefghijklmnopqrstuvwxyz", out: "abcdefghijk-" + hashSuffix("abcdefghijklmnopqrstuvwxyz")},
+		{strict: true, in: "api.dev", out: "api-dev"},
+		{strict: true, in: "/api", err: true},
+		{strict: true, in: long, err: true},
+		{strict: true, maxLength: 10, in: "abcdefghijk", err: true},
+	} {
+		p, err := newNamePolicy("-", tc.maxLength, tc.trim, tc.strict)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m := &Mesos{names: p}
+		out, err := m.sanitizeName(tc.in)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %q", tc.in, out)
+			}
+			continue
+		}
+		if err != nil || out != tc.out {
+			t.Errorf("%q: expected %q, got %q (%v)", tc.in, tc.out, out, err)
+		}
+		if tc.maxLength > 0 && len(out) > tc.maxLength {
+			t.Errorf("%q: %q is longer than %d", tc.in, out, tc.maxLength)
+		}
+	}
+
+	for _, repl := range []string{"x", ".", "", "--"} {
+		if _, err := newNamePolicy(repl, 0, false, false); err == nil {
+			t.Errorf("%q: expected an invalid replacement error", repl)
+		}
+	}
+	for _, repl := range []string{"-", "_"} {
+		if _, err := newNamePolicy(repl, 0, false, false); err != nil {
+			t.Errorf("%q: %s", repl, err)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	"github.com/mesos-utility/mesos-consul/registry"
+	"github.com/mesos-utility/mesos-consul/rules"
 	"github.com/mesos-utility/mesos-consul/state"
 
 	log "github.com/sirupsen/logrus"
@@ -22,7 +23,7 @@ func (m *Mesos) LoadCache() error {
 
 	mh := m.getLeader()
 
-	return m.Registry.CacheLoad(mh.Ip)
+	return m.Registry.CacheLoad(m.masterAgent(mh.Ip))
 }
 
 func (m *Mesos) RegisterHosts(s state.State) {
@@ -38,11 +39,12 @@ func (m *Mesos) RegisterHosts(s state.State) {
 		m.Agents[f.ID] = agent
 
 		m.registerHost(&registry.Service{
-			ID:      fmt.Sprintf("mesos-consul:%s:%s:%s", m.ServiceName, f.ID, f.Hostname),
+			ID:      m.agentServiceID(f),
 			Name:    m.ServiceName,
 			Port:    port,
 			Address: agent,
-			Agent:   agent,
+			Agent:   m.consulAgent(f.ID, agent),
+			Host:    agent,
 			Tags:    m.agentTags("agent", "follower"),
 			Check: &registry.Check{
 				HTTP:     fmt.Sprintf("http://%s:%d/slave(1)/health", agent, port),
@@ -66,7 +68,8 @@ func (m *Mesos) RegisterHosts(s state.State) {
 			Name:    m.ServiceName,
 			Port:    ma.Port,
 			Address: ma.Ip,
-			Agent:   ma.Ip,
+			Agent:   m.masterAgent(ma.Ip),
+			Host:    ma.Ip,
 			Tags:    tags,
 			Check: &registry.Check{
 				HTTP:     fmt.Sprintf("http://%s:%d/master/health", ma.Ip, ma.Port),
@@ -78,6 +81,13 @@ func (m *Mesos) RegisterHosts(s state.State) {
 	}
 }
 
+// agentServiceID()
+//   Return the ID of the service of the Mesos agent
+//
+func (m *Mesos) agentServiceID(s state.Slave) string {
+	return fmt.Sprintf("mesos-consul:%s:%s:%s", m.ServiceName, s.ID, s.Hostname)
+}
+
 // helper function to compare service tag slices
 //
 func sliceEq(a, b []string) bool {
@@ -115,33 +125,54 @@ func (m *Mesos) registerHost(s *registry.Service) {
 	m.Registry.Register(s)
 }
 
-func (m *Mesos) registerTask(t *state.Task, agent string) {
+// registerTask()
+//   Register the services of a task and return their IDs
+//
+func (m *Mesos) registerTask(t *state.Task, agent string) []string {
+	var ids []string
+
+	for _, s := range m.taskServices(t, agent) {
+		m.Registry.Register(s)
+		ids = append(ids, s.ID)
+	}
+
+	return ids
+}
+
+func (m *Mesos) taskServices(t *state.Task, agent string) []*registry.Service {
 	var tags []string
+	var services []*registry.Service
 
-	tname := cleanName(t.Name, m.Separator)
-	if m.whitelistRegex != nil {
-		if !m.whitelistRegex.MatchString(tname) {
-			log.WithField("task", tname).Debug("Task not on whitelist")
-			// No match
-			return
-		}
+	if !m.taskFilter(t) {
+		return nil
 	}
-	if m.blacklistRegex != nil {
-		if m.blacklistRegex.MatchString(tname) {
-			log.WithField("task", tname).Debug("Task on blacklist")
-			// Match
-			return
-		}
+
+	// A name refused for colliding may still be renamed by the rules, so
+	// the collisions are checked in applyRules on the final names
+	tname, err := m.sanitizeName(t.Name)
+	if err != nil {
+		log.WithField("task", t.ID).Warnf("Not registering: %s", err.Error())
+		return nil
+	}
+	if resolved, err := m.serviceName(t); err == nil {
+		tname = resolved
 	}
 
 	address := t.IP(m.IpOrder...)
 
-	l := t.Label("tags")
-	if l != "" {
-		tags = strings.Split(t.Label("tags"), ",")
-	} else {
-		tags = []string{}
+	tags = m.taskTags(t)
+	meta := m.taskMeta(t)
+
+	// Check variables of every service, for the rules
+	var vars []*CheckVar
+
+	// A named discovery port that is also a resource port is registered
+	// once, by the resources loop, with the port name tag
+	resourcePorts := make(map[int]bool)
+	for _, port := range t.Resources.Ports() {
+		resourcePorts[toPort(port)] = true
 	}
+	seen := make(map[string]bool)
 
 	for key := range t.DiscoveryInfo.Ports.DiscoveryPorts {
 		discoveryPort := state.DiscoveryPort(t.DiscoveryInfo.Ports.DiscoveryPorts[key])
@@ -151,48 +182,400 @@ func (m *Mesos) registerTask(t *state.Task, agent string) {
 			t.Name,
 			discoveryPort.Name,
 			discoveryPort.Number)
-		if discoveryPort.Name != "" {
-			m.Registry.Register(&registry.Service{
+		if discoveryPort.Name != "" && !resourcePorts[discoveryPort.Number] {
+			cv := &CheckVar{
+				Host:      toIP(address),
+				Port:      servicePort,
+				PortName:  discoveryPort.Name,
+				PortIndex: key,
+				Protocol:  strings.ToLower(discoveryPort.Protocol),
+				Env:       m.checkEnv,
+			}
+			s := &registry.Service{
 				ID:      fmt.Sprintf("mesos-consul:%s:%s:%d", agent, tname, discoveryPort.Number),
 				Name:    tname,
 				Port:    toPort(servicePort),
 				Address: address,
-				Tags:    []string{serviceName},
-				Check: GetCheck(t, &CheckVar{
-					Host: toIP(address),
-					Port: servicePort,
-				}),
-				Agent: toIP(agent),
-			})
+				Tags:    portTags(serviceName, tags),
+				Meta:    meta,
+				Check:   m.taskCheck(t, cv),
+				Agent:   m.consulAgent(t.SlaveID, toIP(agent)),
+				Host:    toIP(agent),
+			}
+			setProtocol(s, cv.Protocol)
+			if seen[s.ID] {
+				continue
+			}
+			seen[s.ID] = true
+			services = append(services, s)
+			vars = append(vars, cv)
 		}
 	}
 
 	if t.Resources.PortRanges != "" {
-		for _, port := range t.Resources.Ports() {
-			m.Registry.Register(&registry.Service{
-				ID:      fmt.Sprintf("mesos-consul:%s:%s:%s", agent, tname, port),
-				Name:    tname,
-				Port:    toPort(port),
-				Address: address,
-				Tags:    tags,
-				Check: GetCheck(t, &CheckVar{
-					Host: toIP(address),
-					Port: port,
-				}),
-				Agent: toIP(agent),
-			})
+		for i, port := range t.Resources.Ports() {
+			// One service for every protocol the port is declared with
+			for _, p := range portInfo(t, toPort(port), i) {
+				cv := &CheckVar{
+					Host:      toIP(address),
+					Port:      port,
+					PortName:  p.name,
+					PortIndex: p.index,
+					Protocol:  p.protocol,
+					Env:       m.checkEnv,
+				}
+				s := &registry.Service{
+					ID:      fmt.Sprintf("mesos-consul:%s:%s:%s", agent, tname, port),
+					Name:    tname,
+					Port:    toPort(port),
+					Address: address,
+					Tags:    portTags(p.name, tags),
+					Meta:    meta,
+					Check:   m.taskCheck(t, cv),
+					Agent:   m.consulAgent(t.SlaveID, toIP(agent)),
+					Host:    toIP(agent),
+				}
+				setProtocol(s, cv.Protocol)
+				if seen[s.ID] {
+					continue
+				}
+				seen[s.ID] = true
+				services = append(services, s)
+				vars = append(vars, cv)
+			}
 		}
 	} else {
-		m.Registry.Register(&registry.Service{
+		cv := &CheckVar{
+			Host: toIP(address),
+			Env:  m.checkEnv,
+		}
+		services = append(services, &registry.Service{
 			ID:      fmt.Sprintf("mesos-consul:%s-%s", agent, tname),
 			Name:    tname,
 			Address: address,
 			Tags:    tags,
-			Check: GetCheck(t, &CheckVar{
-				Host: toIP(address),
-			}),
-			Agent: toIP(agent),
+			Meta:    meta,
+			Check:   m.taskCheck(t, cv),
+			Agent:   m.consulAgent(t.SlaveID, toIP(agent)),
+			Host:    toIP(agent),
 		})
+		vars = append(vars, cv)
+	}
+
+	// Mesos runs the health checks, Consul only gets their result
+	if m.MesosHealth {
+		health := taskHealth(t)
+		for _, s := range services {
+			s.Check = &registry.Check{TTL: m.healthTTL}
+			s.Health = health
+		}
+	}
+
+	return m.applyRules(t, services, vars)
+}
+
+// applyRules()
+//   Rewrite the services of the task with the rules, and add the aliases
+//   of the services
+//
+func (m *Mesos) applyRules(t *state.Task, services []*registry.Service, vars []*CheckVar) []*registry.Service {
+	var rval []*registry.Service
+	for i, s := range services {
+		cv := vars[i]
+		name := s.Name
+
+		var res rules.Result
+		if m.rules != nil {
+			res = m.rules.Apply(s, m.ruleContext(t, cv.PortName))
+		}
+		if res.Skip {
+			log.WithField("service", s.ID).Debug("Skipped by rule")
+			continue
+		}
+
+		// Renamed services go through the name policies like the others
+		if s.Name != name {
+			renamed, err := m.resolveName(s.Name, taskIdentity(t))
+			if err != nil {
+				log.WithField("service", s.ID).Warnf("Not registering: %s", err.Error())
+				continue
+			}
+			s.Name = renamed
+		} else if _, err := m.serviceName(t); err != nil {
+			log.WithField("service", s.ID).Warnf("Not registering: %s", err.Error())
+			continue
+		}
+
+		if res.AddressSource != "" {
+			if address := t.IP(res.AddressSource); address != "" {
+				s.Address = address
+				cv.Host = toIP(address)
+				if !res.CheckSet && s.Health == "" {
+					s.Check = m.taskCheck(t, cv)
+				}
+			}
+		}
+
+		if res.CheckSet {
+			c, err := expandCheck(t, cv, s.Check)
+			if err != nil {
+				log.WithField("task", t.ID).Warn("Invalid rule check ", err)
+			}
+			s.Check = protocolCheck(t, cv, c)
+			s.Health = ""
+		}
+
+		rval = append(rval, s)
+
+		var aliases []string
+		if l := t.Label("consul_aliases"); l != "" {
+			aliases = strings.Split(l, ",")
+		}
+		aliases = append(aliases, res.Aliases...)
+		if i, ok := m.instanceIndex(t); ok {
+			aliases = append(aliases, fmt.Sprintf("%s-%d", s.Name, i))
+		}
+		rval = append(rval, m.aliases(s, aliases)...)
+	}
+
+	return rval
+}
+
+// ruleContext()
+//   Build the context the rules match the service of a port against
+//
+func (m *Mesos) ruleContext(t *state.Task, portName string) *rules.Context {
+	labels := make(map[string]string, len(t.Labels))
+	for _, l := range t.Labels {
+		labels[l.Key] = l.Value
+	}
+
+	return &rules.Context{
+		TaskName:   t.Name,
+		Framework:  t.FrameworkName,
+		PortName:   portName,
+		Labels:     labels,
+		Attributes: m.slaveAttributes[t.SlaveID],
+	}
+}
+
+// aliases()
+//   Return copies of the service registered under the alias names. They
+//   share the endpoint and the check of the service, and their meta data
+//   points to the service.
+//
+func (m *Mesos) aliases(s *registry.Service, names []string) []*registry.Service {
+	var rval []*registry.Service
+	seen := map[string]bool{s.Name: true}
+
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+
+		name, err := m.sanitizeName(name)
+		if err != nil {
+			log.WithField("service", s.ID).Warnf("Alias not registered: %s", err.Error())
+			continue
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		meta := make(map[string]string, len(s.Meta)+1)
+		for k, v := range s.Meta {
+			meta[k] = v
+		}
+		meta["alias_of"] = s.Name
+
+		alias := *s
+		alias.ID = s.ID + ":alias:" + name
+		alias.Name = name
+		alias.Meta = meta
+		rval = append(rval, &alias)
+	}
+
+	return rval
+}
+
+// taskFilter()
+//   Check the task against the whitelist, the blacklist and its
+//   registration settings
+//
+func (m *Mesos) taskFilter(t *state.Task) bool {
+	tname := cleanName(t.Name, m.Separator)
+	if m.whitelistRegex != nil {
+		if !m.whitelistRegex.MatchString(tname) {
+			log.WithField("task", tname).Debug("Task not on whitelist")
+			// No match
+			return false
+		}
+	}
+	if m.blacklistRegex != nil {
+		if m.blacklistRegex.MatchString(tname) {
+			log.WithField("task", tname).Debug("Task on blacklist")
+			// Match
+			return false
+		}
+	}
+
+	if !m.registrable(t) {
+		log.WithField("task", tname).Debug("Task not registrable")
+		return false
+	}
+
+	return true
+}
+
+// registrable()
+//   Check whether the task opted in to the registration, by label or
+//   visibility, in opt-in mode. Every task is registered otherwise, as
+//   Marathon gives all its tasks a FRAMEWORK visibility.
+//
+func (m *Mesos) registrable(t *state.Task) bool {
+	if m.RegistrationMode != "opt-in" {
+		return true
+	}
+
+	visibility := strings.ToUpper(t.DiscoveryInfo.Visibilty)
+	if visibility == "FRAMEWORK" && !m.IgnoreVisibility {
+		return false
+	}
+
+	if visibility == "EXTERNAL" || visibility == "CLUSTER" {
+		return true
+	}
+
+	value := t.Label(m.registrationKey)
+	if m.registrationValue == "" {
+		return value != "" && value != "false"
+	}
+
+	return value == m.registrationValue
+}
+
+type portDesc struct {
+	name     string
+	index    int
+	protocol string
+}
+
+// portInfo()
+//   Return the name, the index and the protocol of the port in the
+//   discovery info of the task, which follows the port definitions of
+//   Marathon apps, once for every protocol of the port. The index of the
+//   port among the resources is used when the port isn't in the discovery
+//   info.
+//
+func portInfo(t *state.Task, port int, index int) []portDesc {
+	var rval []portDesc
+	seen := make(map[string]bool)
+
+	for i, p := range t.DiscoveryInfo.Ports.DiscoveryPorts {
+		protocol := strings.ToLower(p.Protocol)
+		if p.Number == port && !seen[protocol] {
+			seen[protocol] = true
+			rval = append(rval, portDesc{name: p.Name, index: i, protocol: protocol})
+		}
+	}
+
+	if len(rval) == 0 {
+		return []portDesc{{index: index}}
+	}
+	return rval
+}
+
+// portTags()
+//   Return the tags of a port service: the port name, if any, followed
+//   by the task tags
+//
+func portTags(name string, tags []string) []string {
+	if name == "" {
+		return tags
+	}
+
+	rval := []string{name}
+	for _, tag := range tags {
+		if tag != name {
+			rval = append(rval, tag)
+		}
+	}
+
+	return rval
+}
+
+// setProtocol()
+//   Add the protocol of the port to the meta data of the service. TCP is
+//   the default, services of other protocols also get it as a tag and
+//   appended to their ID, so the TCP and UDP services of a port number
+//   don't collide.
+//
+func setProtocol(s *registry.Service, protocol string) {
+	if protocol == "" {
+		return
+	}
+
+	if protocol != "tcp" {
+		s.ID += ":" + protocol
+
+		tags := make([]string, 0, len(s.Tags)+1)
+		tags = append(tags, s.Tags...)
+		s.Tags = append(tags, protocol)
+	}
+
+	meta := make(map[string]string, len(s.Meta)+1)
+	for k, v := range s.Meta {
+		meta[k] = v
+	}
+	meta["protocol"] = protocol
+	s.Meta = meta
+}
+
+// protocolCheck()
+//   Drop the TCP and HTTP checks of the ports of other protocols than
+//   TCP, which can't pass
+//
+func protocolCheck(t *state.Task, cv *CheckVar, c *registry.Check) *registry.Check {
+	if c == nil || cv.Protocol == "" || cv.Protocol == "tcp" {
+		return c
+	}
+
+	if c.TCP != "" || c.HTTP != "" {
+		log.WithField("task", t.ID).Debugf("Dropping the check of %s port %s", cv.Protocol, cv.Port)
+		return registry.DefaultCheck()
+	}
+
+	return c
+}
+
+// taskCheck()
+//   Build the check of a task service from the task labels, or from the
+//   Marathon health checks of its app. The service is registered without
+//   a check when the labels can't be expanded.
+//
+func (m *Mesos) taskCheck(t *state.Task, cv *CheckVar) *registry.Check {
+	c, err := getCheck(t, cv, m.marathonCheck(t, cv))
+	if err != nil {
+		log.WithField("task", t.ID).Warn("Invalid check label ", err)
+	}
+
+	return protocolCheck(t, cv, c)
+}
+
+// taskHealth()
+//   Return the health of the task from its latest status
+//
+func taskHealth(t *state.Task) string {
+	healthy := t.Healthy()
+
+	switch {
+	case healthy == nil:
+		return registry.HealthWarning
+	case *healthy:
+		return registry.HealthPassing
+	default:
+		return registry.HealthCritical
 	}
 }
 
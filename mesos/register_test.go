@@ -0,0 +1,261 @@
+package mesos
+
+import (
+	"testing"
+
+	"github.com/mesos-utility/mesos-consul/registry"
+	"github.com/mesos-utility/mesos-consul/state"
+)
+
+func TestRegistrable(t *testing.T) {
+	task := func(visibility string, labels ...state.Label) *state.Task {
+		t := &state.Task{Labels: labels}
+		t.DiscoveryInfo.Visibilty = visibility
+		return t
+	}
+	optIn := state.Label{Key: "consul", Value: "true"}
+
+	all := &Mesos{RegistrationMode: "all"}
+	if !all.registrable(task("")) {
+		t.Error("all mode should register tasks without discovery info")
+	}
+	if !all.registrable(task("FRAMEWORK")) {
+		t.Error("all mode should register FRAMEWORK visible tasks")
+	}
+
+	m := &Mesos{RegistrationMode: "opt-in", registrationKey: "consul", registrationValue: "true"}
+	if m.registrable(task("")) {
+		t.Error("opt-in mode shouldn't register tasks without the label")
+	}
+	if !m.registrable(task("", optIn)) {
+		t.Error("opt-in mode should register tasks with the label")
+	}
+	if !m.registrable(task("CLUSTER")) || !m.registrable(task("EXTERNAL")) {
+		t.Error("opt-in mode should register CLUSTER and EXTERNAL visible tasks")
+	}
+	if m.registrable(task("FRAMEWORK", optIn)) {
+		t.Error("FRAMEWORK visible tasks shouldn't be registered")
+	}
+
+	m.IgnoreVisibility = true
+	if !m.registrable(task("FRAMEWORK", optIn)) {
+		t.Error("visibility should be ignored")
+	}
+}
+
+func TestTaskTags(t *testing.T) {
+	m := &Mesos{TagLabelPrefix: "consul.tag.", TagLabels: []string{"team"}, DiscoveryTags: true}
+
+	task := &state.Task{Labels: []state.Label{
+		{Key: "tags", Value: "a, b,a,,bad tag"},
+		{Key: "consul.tag.primary", Value: "true"},
+		{Key: "team", Value: "web"},
+		{Key: "other", Value: "x"},
+	}}
+	task.DiscoveryInfo.Version = "1.2"
+	task.DiscoveryInfo.Labels.Labels = []state.Label{{Key: "b"}, {Key: "zone", Value: "eu/1"}}
+
+	want := []string{"a", "b", "primary", "team=web", "version=1.2"}
+	got := m.taskTags(task)
+	if len(got) != len(want) {
+		t.Fatalf("taskTags() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("taskTags() = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestAliases(t *testing.T) {
+	m := &Mesos{}
+	task := &state.Task{Labels: []state.Label{{Key: "consul_aliases", Value: "new-name, web,new-name"}}}
+	s := &registry.Service{ID: "mesos-consul:10.0.0.1:web:31000", Name: "web", Port: 31000}
+
+	services := m.applyRules(task, []*registry.Service{s}, []*CheckVar{{Port: "31000"}})
+	if len(services) != 2 {
+		t.Fatalf("expected the service and one alias, got %d services", len(services))
+	}
+
+	alias := services[1]
+	if alias.ID != s.ID+":alias:new-name" || alias.Name != "new-name" || alias.Port != s.Port {
+		t.Errorf("unexpected alias %+v", alias)
+	}
+	if alias.Meta["alias_of"] != "web" || s.Meta["alias_of"] != "" {
+		t.Errorf("unexpected alias meta %v, service meta %v", alias.Meta, s.Meta)
+	}
+}
+
+func TestTaskVersion(t *testing.T) {
+	sources, err := parseVersionSources("discovery,label:version,image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Mesos{VersionSources: sources, VersionTag: "v{version}", VersionMeta: "version"}
+
+	task := &state.Task{}
+	task.Container.Docker.Image = "registry:5000/web:1.3"
+	if v := m.taskVersion(task); v != "1.3" {
+		t.Errorf("expected the image tag, got %q", v)
+	}
+
+	task.Labels = []state.Label{{Key: "version", Value: "2"}}
+	if tags := m.versionTags(task); len(tags) != 1 || tags[0] != "v2" {
+		t.Errorf("expected the label version tag, got %v", tags)
+	}
+
+	task.DiscoveryInfo.Version = "3"
+	if meta := m.taskMeta(task); meta["version"] != "3" {
+		t.Errorf("expected the discovery version meta, got %v", meta)
+	}
+
+	if _, err := parseVersionSources("marathon"); err == nil {
+		t.Error("expected an invalid source error")
+	}
+}
+
+func TestContainerMeta(t *testing.T) {
+	m := &Mesos{ContainerTags: true}
+
+	task := &state.Task{ID: "web.1"}
+	if meta := m.taskMeta(task); meta != nil {
+		t.Errorf("expected no meta without container, got %v", meta)
+	}
+
+	task.Container.Type = "DOCKER"
+	task.Container.Docker.Image = "registry:5000/team/web:1.3"
+	task.Container.Docker.Network = "BRIDGE"
+	task.Container.Volumes = []state.Volume{{ContainerPath: "/data", Mode: "RW"}}
+
+	meta := m.taskMeta(task)
+	for k, v := range map[string]string{
+		"container_type": "docker",
+		"image":          "registry:5000/team/web:1.3",
+		"image_name":     "registry:5000/team/web",
+		"image_tag":      "1.3",
+		"network_mode":   "bridge",
+		"volumes":        "1",
+	} {
+		if meta[k] != v {
+			t.Errorf("expected %s=%q, got %q", k, v, meta[k])
+		}
+	}
+
+	tags := m.taskTags(task)
+	if len(tags) != 2 || tags[0] != "image=web" || tags[1] != "image_tag=1.3" {
+		t.Errorf("unexpected container tags %v", tags)
+	}
+}
+
+func TestProtocols(t *testing.T) {
+	m := &Mesos{RegistrationMode: "all", IpOrder: []string{"host"}}
+
+	task := &state.Task{
+		ID:        "dns.1",
+		Name:      "dns",
+		SlaveIP:   "10.0.0.1",
+		Resources: state.Resources{PortRanges: "[53-53]"},
+		Labels:    []state.Label{{Key: "check_http", Value: "http://{host}:{port}/"}, {Key: "check_interval", Value: "10s"}},
+	}
+	task.DiscoveryInfo.Ports.DiscoveryPorts = []state.DiscoveryPort{
+		{Protocol: "tcp", Number: 53},
+		{Protocol: "udp", Number: 53},
+	}
+
+	services := m.taskServices(task, "10.0.0.1")
+	if len(services) != 2 {
+		t.Fatalf("expected a service per protocol, got %d", len(services))
+	}
+
+	tcp, udp := services[0], services[1]
+	if tcp.ID == udp.ID || udp.ID != tcp.ID+":udp" {
+		t.Errorf("unexpected service IDs %s and %s", tcp.ID, udp.ID)
+	}
+	if tcp.Meta["protocol"] != "tcp" || udp.Meta["protocol"] != "udp" {
+		t.Errorf("unexpected protocol meta %v and %v", tcp.Meta, udp.Meta)
+	}
+	for _, tag := range tcp.Tags {
+		if tag == "tcp" {
+			t.Errorf("unexpected tcp tag in %v", tcp.Tags)
+		}
+	}
+	if len(udp.Tags) == 0 || udp.Tags[len(udp.Tags)-1] != "udp" {
+		t.Errorf("expected the udp tag in %v", udp.Tags)
+	}
+	if tcp.Check.HTTP == "" {
+		t.Errorf("expected an HTTP check on the TCP port")
+	}
+	if udp.Check.HTTP != "" {
+		t.Errorf("unexpected HTTP check %s on the UDP port", udp.Check.HTTP)
+	}
+}
+
+func TestTaskServices_NamedResourcePort(t *testing.T) {
+	m := &Mesos{RegistrationMode: "all", IpOrder: []string{"host"}}
+
+	task := &state.Task{
+		ID:        "web.1",
+		Name:      "web",
+		SlaveIP:   "10.0.0.1",
+		Resources: state.Resources{PortRanges: "[31000-31001]"},
+		Labels:    []state.Label{{Key: "tags", Value: "public"}},
+	}
+	task.DiscoveryInfo.Ports.DiscoveryPorts = []state.DiscoveryPort{
+		{Number: 31000, Name: "http"},
+		{Number: 31001},
+	}
+
+	services := m.taskServices(task, "10.0.0.1")
+	if len(services) != 2 {
+		t.Fatalf("expected a service per port, got %d", len(services))
+	}
+
+	ids := make(map[string]bool)
+	for _, s := range services {
+		if ids[s.ID] {
+			t.Errorf("service %s registered twice", s.ID)
+		}
+		ids[s.ID] = true
+	}
+
+	if tags := services[0].Tags; len(tags) != 2 || tags[0] != "http" || tags[1] != "public" {
+		t.Errorf("expected the port name and the task tags, got %v", tags)
+	}
+	if tags := services[1].Tags; len(tags) != 1 || tags[0] != "public" {
+		t.Errorf("expected the task tags, got %v", tags)
+	}
+}
+
+func TestTaskServices_DiscoveryPortTags(t *testing.T) {
+	m := &Mesos{RegistrationMode: "all", IpOrder: []string{"host"}, TagLabels: []string{"team"}, DiscoveryTags: true, ContainerTags: true}
+
+	task := &state.Task{
+		ID:      "web.1",
+		Name:    "web",
+		SlaveIP: "10.0.0.1",
+		Labels:  []state.Label{{Key: "team", Value: "front"}},
+	}
+	task.DiscoveryInfo.Environment = "prod"
+	task.DiscoveryInfo.Ports.DiscoveryPorts = []state.DiscoveryPort{{Number: 8080, Name: "http"}}
+	task.Container.Docker.Image = "web:1.3"
+
+	var port *registry.Service
+	for _, s := range m.taskServices(task, "10.0.0.1") {
+		if s.Port == 8080 {
+			port = s
+		}
+	}
+	if port == nil {
+		t.Fatal("no service for the discovery port")
+	}
+
+	want := []string{"http", "team=front", "environment=prod", "image=web", "image_tag=1.3"}
+	if len(port.Tags) != len(want) {
+		t.Fatalf("discovery port tags = %v, want %v", port.Tags, want)
+	}
+	for i := range want {
+		if port.Tags[i] != want[i] {
+			t.Fatalf("discovery port tags = %v, want %v", port.Tags, want)
+		}
+	}
+}
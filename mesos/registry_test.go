@@ -0,0 +1,43 @@
+package mesos
+
+import (
+	"github.com/mesos-utility/mesos-consul/registry"
+)
+
+// fakeRegistry records the registrations and maintenances of a sync
+type fakeRegistry struct {
+	services map[string]*registry.Service
+	keys     map[string]string
+	keysErr  error
+
+	nodeMaintenance    map[string]string
+	serviceMaintenance map[string]string
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{services: make(map[string]*registry.Service)}
+}
+
+func (r *fakeRegistry) CacheCreate() bool                       { return false }
+func (r *fakeRegistry) CacheDelete(id string)                   { delete(r.services, id) }
+func (r *fakeRegistry) CacheLoad(string) error                  { return nil }
+func (r *fakeRegistry) CacheLookup(id string) *registry.Service { return r.services[id] }
+func (r *fakeRegistry) CacheMark(string)                        {}
+func (r *fakeRegistry) CacheMarkAgent(string)                   {}
+func (r *fakeRegistry) Register(s *registry.Service)            { r.services[s.ID] = s }
+func (r *fakeRegistry) Deregister()                             {}
+func (r *fakeRegistry) DeregisterIDs([]string)                  {}
+func (r *fakeRegistry) SetAgents([]*registry.Agent)             {}
+
+func (r *fakeRegistry) CatalogNodes(string) ([]*registry.Agent, error) {
+	return nil, nil
+}
+
+func (r *fakeRegistry) Maintenance(nodes map[string]string, services map[string]string) {
+	r.nodeMaintenance = nodes
+	r.serviceMaintenance = services
+}
+
+func (r *fakeRegistry) MaintenanceKeys(string) (map[string]string, error) {
+	return r.keys, r.keysErr
+}
@@ -1,67 +1,252 @@
 package mesos
 
 import (
-	"regexp"
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
 	"strings"
 
 	"github.com/mesos-utility/mesos-consul/registry"
 	"github.com/mesos-utility/mesos-consul/state"
 )
 
+// CheckVar holds the values of the variables of the check labels of a
+// task service
 type CheckVar struct {
-	Host string
-	Port string
-}
+	Host      string
+	Port      string
+	PortName  string
+	PortIndex int
+	Protocol  string
+	Task      *state.Task
 
-var globalCV *CheckVar
+	// Environment variables that may be expanded
+	Env map[string]bool
+}
 
 // Task Methods
 
 // GetCheck()
-//   Build a Check structure from the Task labels
+//   Build a Check structure from the Task labels. Labels scoped to the
+//   port of the service, check_<type>_port<index> or
+//   check_<type>_<port name>, override the check_<type> ones, and
+//   check_port<index>=none or check_<port name>=none leaves the port
+//   without a check.
 //
-func GetCheck(t *state.Task, cv *CheckVar) *registry.Check {
+func GetCheck(t *state.Task, cv *CheckVar) (*registry.Check, error) {
+	return getCheck(t, cv, nil)
+}
+
+// getCheck()
+//   Build a Check structure from the Task labels, falling back to the
+//   base check when no label sets an HTTP, script or TTL check
+//
+func getCheck(t *state.Task, cv *CheckVar, base *registry.Check) (*registry.Check, error) {
 	c := registry.DefaultCheck()
+	cv.Task = t
+	custom := false
+
+	for _, scoped := range []bool{false, true} {
+		for _, l := range t.Labels {
+			typ, scope, ok := checkLabel(l.Key)
+			if !ok || (scope != "") != scoped || (scoped && !cv.inScope(scope)) {
+				continue
+			}
+
+			if typ == "" {
+				if strings.ToLower(l.Value) == "none" {
+					return registry.DefaultCheck(), nil
+				}
+				continue
+			}
+
+			if err := setCheck(c, typ, cv, l.Value); err != nil {
+				return registry.DefaultCheck(), fmt.Errorf("%s: %s", l.Key, err.Error())
+			}
+			if typ != "interval" {
+				custom = true
+			}
+		}
+	}
+
+	if !custom && base != nil {
+		b := *base
+		if c.Interval != "" {
+			b.Interval = c.Interval
+		}
+		return &b, nil
+	}
 
-	for _, l := range t.Labels {
+	return c, nil
+}
+
+var checkTypes = []string{"http", "script", "ttl", "interval"}
 
-		k := strings.ToLower(l.Key)
+// checkLabel()
+//   Split a check label into the check type and the port scope. The
+//   type is empty for check_<scope> labels.
+//
+func checkLabel(key string) (typ string, scope string, ok bool) {
+	k := strings.ToLower(key)
+	if !strings.HasPrefix(k, "check_") {
+		return "", "", false
+	}
+	k = strings.TrimPrefix(k, "check_")
 
-		switch k {
-		case "check_http":
-			c.HTTP = interpolate(cv, l.Value)
-		case "check_script":
-			c.Script = interpolate(cv, l.Value)
-		case "check_ttl":
-			c.TTL = interpolate(cv, l.Value)
-		case "check_interval":
-			c.Interval = l.Value
+	for _, t := range checkTypes {
+		if k == t {
+			return t, "", true
+		}
+		if strings.HasPrefix(k, t+"_") {
+			return t, strings.TrimPrefix(k, t+"_"), true
 		}
 	}
 
-	return c
+	return "", k, k != ""
 }
 
-// Replace {variables} with values
+// setCheck()
+//   Set the field of the check for the type. "none" clears the field.
 //
-func interpolate(cv *CheckVar, s string) string {
-	r := regexp.MustCompile("{[^}]*}")
+func setCheck(c *registry.Check, typ string, cv *CheckVar, value string) error {
+	if strings.ToLower(value) == "none" {
+		value = ""
+	} else if typ != "interval" {
+		var err error
+		if value, err = interpolate(cv, value); err != nil {
+			return err
+		}
+	}
 
-	globalCV = cv
-	rval := r.ReplaceAllStringFunc(s, varReplace)
+	switch typ {
+	case "http":
+		c.HTTP = value
+	case "script":
+		c.Script = value
+	case "ttl":
+		c.TTL = value
+	case "interval":
+		c.Interval = value
+	}
 
-	return string(rval)
+	return nil
 }
 
-// Replacement function
+// inScope()
+//   Tell whether a port scope designates the port of the service
 //
-func varReplace(s string) string {
-	switch s {
-	case "{port}":
-		return globalCV.Port
-	case "{host}":
-		return globalCV.Host
-	default:
-		return s
+func (cv *CheckVar) inScope(scope string) bool {
+	if cv.Port == "" {
+		return false
 	}
+
+	return scope == fmt.Sprintf("port%d", cv.PortIndex) ||
+		(cv.PortName != "" && scope == strings.ToLower(cv.PortName))
+}
+
+// expandCheck()
+//   Replace the variables of a check set by a rule
+//
+func expandCheck(t *state.Task, cv *CheckVar, c *registry.Check) (*registry.Check, error) {
+	var err error
+
+	rval := *c
+	cv.Task = t
+	for _, f := range []*string{&rval.HTTP, &rval.TCP, &rval.Script} {
+		if *f, err = interpolate(cv, *f); err != nil {
+			return registry.DefaultCheck(), err
+		}
+	}
+
+	return &rval, nil
+}
+
+// interpolate()
+//   Replace {variables} with values. '{{' and '}}' stand for literal
+//   braces.
+//
+func interpolate(cv *CheckVar, s string) (string, error) {
+	var b bytes.Buffer
+
+	for i := 0; i < len(s); i++ {
+		switch {
+		case strings.HasPrefix(s[i:], "{{"):
+			b.WriteByte('{')
+			i++
+		case strings.HasPrefix(s[i:], "}}"):
+			b.WriteByte('}')
+			i++
+		case s[i] == '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("Unterminated variable in '%s'", s)
+			}
+
+			v, err := cv.lookup(s[i+1 : i+end])
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(v)
+			i += end
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+
+	return b.String(), nil
+}
+
+// lookup()
+//   Return the value of the variable
+//
+func (cv *CheckVar) lookup(name string) (string, error) {
+	switch name {
+	case "host":
+		return cv.Host, nil
+	case "port":
+		return cv.Port, nil
+	case "port_name":
+		return cv.PortName, nil
+	case "port_index":
+		return strconv.Itoa(cv.PortIndex), nil
+	}
+
+	if cv.Task != nil {
+		switch name {
+		case "task_id":
+			return cv.Task.ID, nil
+		case "task_name":
+			return cv.Task.Name, nil
+		case "agent_ip":
+			return cv.Task.SlaveIP, nil
+		case "agent_hostname":
+			return cv.Task.SlaveHostname, nil
+		case "framework":
+			return cv.Task.FrameworkName, nil
+		case "environment":
+			return cv.Task.DiscoveryInfo.Environment, nil
+		}
+
+		if key := strings.TrimPrefix(name, "label:"); key != name {
+			for _, l := range cv.Task.Labels {
+				if l.Key == key {
+					return l.Value, nil
+				}
+			}
+			return "", fmt.Errorf("Unknown label in {%s}", name)
+		}
+	}
+
+	if key := strings.TrimPrefix(name, "env:"); key != name {
+		if !cv.Env[key] {
+			return "", fmt.Errorf("Environment variable not allowed in {%s}", name)
+		}
+		if v, ok := os.LookupEnv(key); ok {
+			return v, nil
+		}
+		return "", fmt.Errorf("Unknown environment variable in {%s}", name)
+	}
+
+	return "", fmt.Errorf("Unknown variable {%s}", name)
 }
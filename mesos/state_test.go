@@ -0,0 +1,91 @@
+package mesos
+
+import (
+	"os"
+	"testing"
+
+	"github.com/mesos-utility/mesos-consul/state"
+)
+
+func TestInterpolate(t *testing.T) {
+	task := &state.Task{
+		ID:            "web.1",
+		Name:          "web",
+		SlaveIP:       "10.0.0.1",
+		SlaveHostname: "agent1",
+		FrameworkName: "marathon",
+		Labels:        []state.Label{{Key: "path", Value: "/health"}},
+	}
+	cv := &CheckVar{Host: "10.0.0.2", Port: "31000", PortName: "http", PortIndex: 1, Task: task}
+
+	tests := map[string]string{
+		"http://{host}:{port}{label:path}":    "http://10.0.0.2:31000/health",
+		"{task_id} {task_name} {framework}":   "web.1 web marathon",
+		"{agent_ip} {agent_hostname}":         "10.0.0.1 agent1",
+		"{port_name}/{port_index}":            "http/1",
+		"check --json '{{\"port\": {port}}}'": "check --json '{\"port\": 31000}'",
+	}
+	for in, want := range tests {
+		got, err := interpolate(cv, in)
+		if err != nil {
+			t.Errorf("interpolate(%q) failed: %s", in, err)
+		} else if got != want {
+			t.Errorf("interpolate(%q) = %q, want %q", in, got, want)
+		}
+	}
+
+	for _, in := range []string{"{nope}", "{label:nope}", "{host"} {
+		if _, err := interpolate(cv, in); err == nil {
+			t.Errorf("interpolate(%q) should fail", in)
+		}
+	}
+}
+
+func TestInterpolate_Env(t *testing.T) {
+	os.Setenv("MESOS_CONSUL_TEST_DOMAIN", "example.com")
+	os.Setenv("MESOS_CONSUL_TEST_TOKEN", "secret")
+	defer os.Unsetenv("MESOS_CONSUL_TEST_DOMAIN")
+	defer os.Unsetenv("MESOS_CONSUL_TEST_TOKEN")
+
+	cv := &CheckVar{Env: map[string]bool{"MESOS_CONSUL_TEST_DOMAIN": true, "MESOS_CONSUL_TEST_UNSET": true}}
+
+	got, err := interpolate(cv, "http://{env:MESOS_CONSUL_TEST_DOMAIN}/")
+	if err != nil || got != "http://example.com/" {
+		t.Errorf("allowed variable: got %q, %v", got, err)
+	}
+
+	// Variables outside the allowlist are never expanded, even when set
+	for _, in := range []string{"http://evil/{env:MESOS_CONSUL_TEST_TOKEN}", "{env:MESOS_CONSUL_TEST_UNSET}"} {
+		if got, err := interpolate(cv, in); err == nil {
+			t.Errorf("interpolate(%q) = %q, should fail", in, got)
+		}
+	}
+	if got, err := interpolate(&CheckVar{}, "{env:MESOS_CONSUL_TEST_DOMAIN}"); err == nil {
+		t.Errorf("expanded %q without allowlist", got)
+	}
+}
+
+func TestGetCheck_PortScopes(t *testing.T) {
+	task := &state.Task{
+		Labels: []state.Label{
+			{Key: "check_http", Value: "http://{host}:{port}/"},
+			{Key: "check_http_admin", Value: "http://{host}:{port}/ping"},
+			{Key: "check_port2", Value: "none"},
+		},
+	}
+
+	c, _ := GetCheck(task, &CheckVar{Host: "h", Port: "1", PortIndex: 0, PortName: "web"})
+	if c.HTTP != "http://h:1/" {
+		t.Errorf("port0 check = %q", c.HTTP)
+	}
+
+	c, _ = GetCheck(task, &CheckVar{Host: "h", Port: "2", PortIndex: 1, PortName: "admin"})
+	if c.HTTP != "http://h:2/ping" {
+		t.Errorf("admin check = %q", c.HTTP)
+	}
+
+	c, _ = GetCheck(task, &CheckVar{Host: "h", Port: "3", PortIndex: 2})
+	if c.HTTP != "" {
+		t.Errorf("port2 check = %q, want none", c.HTTP)
+	}
+}
@@ -0,0 +1,165 @@
+package mesos
+
+import (
+	"path"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/mesos-utility/mesos-consul/state"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// taskTags()
+//   Build the tags of the services of a task from the tags label, the
+//   labels mapped to tags and the discovery info
+//
+func (m *Mesos) taskTags(t *state.Task) []string {
+	var tags []string
+
+	if l := t.Label("tags"); l != "" {
+		tags = append(tags, strings.Split(l, ",")...)
+	}
+
+	for _, l := range t.Labels {
+		if m.TagLabelPrefix != "" && strings.HasPrefix(l.Key, m.TagLabelPrefix) {
+			tags = append(tags, strings.TrimPrefix(l.Key, m.TagLabelPrefix))
+		}
+		for _, k := range m.TagLabels {
+			if l.Key == k {
+				tags = append(tags, l.Key+"="+l.Value)
+			}
+		}
+	}
+
+	if m.DiscoveryTags {
+		for _, l := range t.DiscoveryInfo.Labels.Labels {
+			if l.Value == "" {
+				tags = append(tags, l.Key)
+			} else {
+				tags = append(tags, l.Key+"="+l.Value)
+			}
+		}
+		for _, kv := range [][2]string{
+			{"version", t.DiscoveryInfo.Version},
+			{"environment", t.DiscoveryInfo.Environment},
+			{"location", t.DiscoveryInfo.Location},
+		} {
+			if kv[1] != "" {
+				tags = append(tags, kv[0]+"="+kv[1])
+			}
+		}
+	}
+
+	tags = append(tags, m.versionTags(t)...)
+	tags = append(tags, m.instanceTags(t)...)
+
+	if m.ContainerTags {
+		if name, tag := state.SplitImage(t.Image()); name != "" {
+			tags = append(tags, "image="+path.Base(name))
+			if tag != "" {
+				tags = append(tags, "image_tag="+tag)
+			}
+		}
+	}
+
+	return cleanTags(t.ID, tags)
+}
+
+// taskMeta()
+//   Build the meta data shared by the services of a task: its version,
+//   instance index, container and resources
+//
+func (m *Mesos) taskMeta(t *state.Task) map[string]string {
+	meta := make(map[string]string)
+
+	if m.VersionMeta != "" {
+		if v := m.taskVersion(t); v != "" {
+			meta[m.VersionMeta] = v
+		}
+	}
+
+	if i, ok := m.instanceIndex(t); ok {
+		meta["instance"] = strconv.Itoa(i)
+	}
+
+	c := t.Container
+	if c.Type != "" {
+		meta["container_type"] = strings.ToLower(c.Type)
+		meta["volumes"] = strconv.Itoa(len(c.Volumes))
+	}
+	if image := t.Image(); image != "" {
+		name, tag := state.SplitImage(image)
+		meta["image"] = image
+		meta["image_name"] = name
+		if tag != "" {
+			meta["image_tag"] = tag
+		}
+	}
+	if c.Docker.Network != "" {
+		meta["network_mode"] = strings.ToLower(c.Docker.Network)
+	}
+
+	for _, r := range []struct {
+		key   string
+		value float64
+	}{
+		{"cpus", t.Resources.CPUs},
+		{"mem", t.Resources.Mem},
+		{"disk", t.Resources.Disk},
+		{"gpus", t.Resources.GPUs},
+	} {
+		if r.value > 0 {
+			meta[r.key] = strconv.FormatFloat(r.value, 'f', -1, 64)
+		}
+	}
+
+	if len(meta) == 0 {
+		return nil
+	}
+	return meta
+}
+
+// cleanTags()
+//   Trim the tags, drop the duplicates and the tags Consul can't serve
+//
+func cleanTags(id string, tags []string) []string {
+	rval := []string{}
+	seen := make(map[string]bool)
+
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+
+		if !validTag(tag) {
+			log.WithField("task", id).Warnf("Dropping invalid tag '%s'", tag)
+			continue
+		}
+
+		seen[tag] = true
+		rval = append(rval, tag)
+	}
+
+	return rval
+}
+
+// validTag()
+//   Consul tags show up in DNS names and HTTP API paths, so they can't
+//   hold whitespace, control characters or slashes
+//
+func validTag(tag string) bool {
+	if len(tag) > 255 {
+		return false
+	}
+
+	for _, r := range tag {
+		if unicode.IsSpace(r) || unicode.IsControl(r) || r == '/' {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,78 @@
+package mesos
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mesos-utility/mesos-consul/state"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// parseVersionSources()
+//   Check the sources of the task versions: 'discovery', 'image' or
+//   'label:<key>'
+//
+func parseVersionSources(sources string) ([]string, error) {
+	var rval []string
+
+	for _, src := range strings.Split(sources, ",") {
+		src = strings.TrimSpace(src)
+		switch {
+		case src == "":
+			continue
+		case src == "discovery", src == "image":
+		case strings.HasPrefix(src, "label:") && len(src) > len("label:"):
+		default:
+			return nil, fmt.Errorf("invalid version source '%s'", src)
+		}
+		rval = append(rval, src)
+	}
+
+	return rval, nil
+}
+
+// taskVersion()
+//   Return the version of the task from the first source providing one
+//
+func (m *Mesos) taskVersion(t *state.Task) string {
+	for _, src := range m.VersionSources {
+		var v string
+		switch src {
+		case "discovery":
+			v = t.DiscoveryInfo.Version
+		case "image":
+			_, v = state.SplitImage(t.Image())
+		default:
+			v = t.Label(strings.TrimPrefix(src, "label:"))
+		}
+
+		if v = strings.TrimSpace(v); v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
+
+// versionTags()
+//   Return the version tag of the task, if any
+//
+func (m *Mesos) versionTags(t *state.Task) []string {
+	if m.VersionTag == "" {
+		return nil
+	}
+
+	v := m.taskVersion(t)
+	if v == "" {
+		return nil
+	}
+
+	tag := strings.Replace(m.VersionTag, "{version}", v, -1)
+	if !validTag(tag) {
+		log.WithField("task", t.ID).Warnf("Dropping invalid version tag '%s'", tag)
+		return nil
+	}
+
+	return []string{tag}
+}
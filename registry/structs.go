@@ -4,7 +4,9 @@ type Check struct {
 	Script   string
 	TTL      string
 	HTTP     string
+	TCP      string
 	Interval string
+	Timeout  string
 }
 
 type Service struct {
@@ -13,8 +15,30 @@ type Service struct {
 	Port    int
 	Address string
 	Tags    []string
+	Meta    map[string]string
 	Check   *Check
 	Agent   string
+
+	// IP of the Mesos agent or master of the service, which names its
+	// nginx upstream key whatever Consul agent it is registered with
+	Host string
+
+	// Health fed into the TTL check of the service, if any
+	Health string
+}
+
+// Health of a service, as reported by Mesos
+const (
+	HealthPassing  = "passing"
+	HealthWarning  = "warning"
+	HealthCritical = "critical"
+)
+
+// Agent links the IP of a Mesos agent or master to its Consul agent
+type Agent struct {
+	IP      string
+	Node    string
+	Address string
 }
 
 type Registry interface {
@@ -23,9 +47,19 @@ type Registry interface {
 	CacheLoad(string) error
 	CacheLookup(string) *Service
 	CacheMark(string)
+	CacheMarkAgent(string)
 
 	Register(*Service)
 	Deregister()
+	DeregisterIDs([]string)
+
+	// Maintenance takes the maintenance reasons by Consul agent and by
+	// service ID
+	Maintenance(map[string]string, map[string]string)
+	MaintenanceKeys(string) (map[string]string, error)
+
+	SetAgents([]*Agent)
+	CatalogNodes(string) ([]*Agent, error)
 }
 
 func DefaultCheck() *Check {
@@ -33,6 +67,8 @@ func DefaultCheck() *Check {
 		TTL:      "",
 		Script:   "",
 		HTTP:     "",
+		TCP:      "",
 		Interval: "",
+		Timeout:  "",
 	}
 }
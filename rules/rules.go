@@ -0,0 +1,309 @@
+package rules
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+
+	"github.com/mesos-utility/mesos-consul/registry"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Rule hits by rule name, published on /debug/vars of the healthcheck
+// endpoint
+var hits = expvar.NewMap("rules")
+
+// Match holds the regular expressions a service has to match for the
+// actions of a rule to apply. Empty fields match anything.
+type Match struct {
+	TaskName   string            `json:"task_name"`
+	Framework  string            `json:"framework"`
+	PortName   string            `json:"port_name"`
+	Labels     map[string]string `json:"labels"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+// Check holds the check set by a rule
+type Check struct {
+	HTTP     string `json:"http"`
+	TCP      string `json:"tcp"`
+	Script   string `json:"script"`
+	TTL      string `json:"ttl"`
+	Interval string `json:"interval"`
+	Timeout  string `json:"timeout"`
+}
+
+// Actions holds the changes a rule makes to the services it matches
+type Actions struct {
+	Rename        string            `json:"rename"`
+	AddTags       []string          `json:"add_tags"`
+	RemoveTags    []string          `json:"remove_tags"`
+	Meta          map[string]string `json:"meta"`
+	AddressSource string            `json:"address_source"`
+	Check         *Check            `json:"check"`
+	Aliases       []string          `json:"aliases"`
+	Skip          bool              `json:"skip"`
+}
+
+// Rule holds a rule of the rules section of the configuration file
+type Rule struct {
+	Name    string  `json:"name"`
+	Match   Match   `json:"match"`
+	Actions Actions `json:"actions"`
+}
+
+// Context holds what the rules match a service on
+type Context struct {
+	TaskName   string
+	Framework  string
+	PortName   string
+	Labels     map[string]string
+	Attributes map[string]string
+}
+
+// Result holds the actions the caller has to carry out
+type Result struct {
+	Skip          bool
+	AddressSource string
+	CheckSet      bool
+	Aliases       []string
+}
+
+type matcher struct {
+	taskName   *regexp.Regexp
+	framework  *regexp.Regexp
+	portName   *regexp.Regexp
+	labels     map[string]*regexp.Regexp
+	attributes map[string]*regexp.Regexp
+}
+
+type rule struct {
+	Rule
+	match matcher
+}
+
+// Engine evaluates the rules in order
+type Engine struct {
+	rules []*rule
+}
+
+// Load reads the rules section of a JSON configuration file. An empty
+// file name gives an engine without rules.
+func Load(file string) (*Engine, error) {
+	e := new(Engine)
+	if file == "" {
+		return e, nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg struct {
+		Rules []Rule `json:"rules"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+
+	return New(cfg.Rules)
+}
+
+// New compiles the rules into an engine.
+func New(rules []Rule) (*Engine, error) {
+	e := new(Engine)
+
+	for i, r := range rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule-%d", i)
+		}
+
+		m, err := compile(r.Match)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %s", r.Name, err.Error())
+		}
+
+		switch r.Actions.AddressSource {
+		case "", "netinfo", "host", "docker", "mesos":
+		default:
+			return nil, fmt.Errorf("rule %s: invalid address source '%s'", r.Name, r.Actions.AddressSource)
+		}
+
+		e.rules = append(e.rules, &rule{Rule: r, match: m})
+	}
+
+	return e, nil
+}
+
+func compile(m Match) (matcher, error) {
+	var c matcher
+	var err error
+
+	for _, f := range []struct {
+		re  **regexp.Regexp
+		src string
+	}{
+		{&c.taskName, m.TaskName},
+		{&c.framework, m.Framework},
+		{&c.portName, m.PortName},
+	} {
+		if f.src == "" {
+			continue
+		}
+		if *f.re, err = regexp.Compile(f.src); err != nil {
+			return c, err
+		}
+	}
+
+	if c.labels, err = compileMap(m.Labels); err != nil {
+		return c, err
+	}
+	if c.attributes, err = compileMap(m.Attributes); err != nil {
+		return c, err
+	}
+
+	return c, nil
+}
+
+func compileMap(m map[string]string) (map[string]*regexp.Regexp, error) {
+	rval := make(map[string]*regexp.Regexp, len(m))
+	for k, v := range m {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return nil, err
+		}
+		rval[k] = re
+	}
+
+	return rval, nil
+}
+
+// matches tells whether the context matches every field of the rule.
+// Labels and attributes have to be present to match.
+func (m *matcher) matches(ctx *Context) bool {
+	for _, f := range []struct {
+		re    *regexp.Regexp
+		value string
+	}{
+		{m.taskName, ctx.TaskName},
+		{m.framework, ctx.Framework},
+		{m.portName, ctx.PortName},
+	} {
+		if f.re != nil && !f.re.MatchString(f.value) {
+			return false
+		}
+	}
+
+	for k, re := range m.labels {
+		if v, ok := ctx.Labels[k]; !ok || !re.MatchString(v) {
+			return false
+		}
+	}
+	for k, re := range m.attributes {
+		if v, ok := ctx.Attributes[k]; !ok || !re.MatchString(v) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Rename returns the name the rules rename a service matching the context
+// to, empty when no rule renames it or a rule skips it. No action is
+// carried out.
+func (e *Engine) Rename(ctx *Context) string {
+	name := ""
+	for _, r := range e.rules {
+		if !r.match.matches(ctx) {
+			continue
+		}
+		if r.Actions.Skip {
+			return ""
+		}
+		if r.Actions.Rename != "" {
+			name = r.Actions.Rename
+		}
+	}
+
+	return name
+}
+
+// Apply evaluates the rules in order on the service and carries out the
+// actions of the ones it matches. Evaluation stops at the first rule
+// skipping the service.
+func (e *Engine) Apply(s *registry.Service, ctx *Context) Result {
+	var res Result
+
+	for _, r := range e.rules {
+		if !r.match.matches(ctx) {
+			continue
+		}
+
+		log.WithFields(log.Fields{"rule": r.Name, "service": s.ID}).Debug("Rule matched")
+		hits.Add(r.Name, 1)
+
+		a := &r.Actions
+		if a.Skip {
+			res.Skip = true
+			return res
+		}
+
+		if a.Rename != "" {
+			s.Name = a.Rename
+		}
+
+		s.Tags = removeTags(append(append([]string{}, s.Tags...), a.AddTags...), a.RemoveTags)
+
+		if len(a.Meta) > 0 {
+			meta := make(map[string]string, len(s.Meta)+len(a.Meta))
+			for k, v := range s.Meta {
+				meta[k] = v
+			}
+			for k, v := range a.Meta {
+				meta[k] = v
+			}
+			s.Meta = meta
+		}
+
+		if a.AddressSource != "" {
+			res.AddressSource = a.AddressSource
+		}
+
+		res.Aliases = append(res.Aliases, a.Aliases...)
+
+		if a.Check != nil {
+			s.Check = &registry.Check{
+				HTTP:     a.Check.HTTP,
+				TCP:      a.Check.TCP,
+				Script:   a.Check.Script,
+				TTL:      a.Check.TTL,
+				Interval: a.Check.Interval,
+				Timeout:  a.Check.Timeout,
+			}
+			res.CheckSet = true
+		}
+	}
+
+	return res
+}
+
+func removeTags(tags []string, remove []string) []string {
+	rval := []string{}
+	seen := make(map[string]bool)
+
+	for _, r := range remove {
+		seen[r] = true
+	}
+	for _, t := range tags {
+		if !seen[t] {
+			seen[t] = true
+			rval = append(rval, t)
+		}
+	}
+
+	return rval
+}
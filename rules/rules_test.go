@@ -0,0 +1,104 @@
+package rules
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mesos-utility/mesos-consul/registry"
+)
+
+func TestEngine_Apply(t *testing.T) {
+	e, err := New([]Rule{
+		{
+			Name:    "skip-batch",
+			Match:   Match{Framework: "^chronos$"},
+			Actions: Actions{Skip: true},
+		},
+		{
+			Name:  "metrics",
+			Match: Match{PortName: "^metrics$", Labels: map[string]string{"team": "web"}},
+			Actions: Actions{
+				Rename:     "metrics",
+				AddTags:    []string{"prometheus"},
+				RemoveTags: []string{"old"},
+				Meta:       map[string]string{"scrape": "true"},
+				Check:      &Check{HTTP: "http://{host}:{port}/metrics"},
+			},
+		},
+		{
+			Name:    "edge",
+			Match:   Match{Attributes: map[string]string{"rack": "^edge-"}},
+			Actions: Actions{AddressSource: "host"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &registry.Service{Name: "web", Tags: []string{"old", "a"}, Check: registry.DefaultCheck()}
+	res := e.Apply(s, &Context{
+		Framework:  "marathon",
+		PortName:   "metrics",
+		Labels:     map[string]string{"team": "web"},
+		Attributes: map[string]string{"rack": "edge-1"},
+	})
+
+	if res.Skip || !res.CheckSet || res.AddressSource != "host" {
+		t.Errorf("unexpected result %+v", res)
+	}
+	if s.Name != "metrics" || !reflect.DeepEqual(s.Tags, []string{"a", "prometheus"}) || s.Meta["scrape"] != "true" {
+		t.Errorf("unexpected service %+v", s)
+	}
+	if s.Check.HTTP != "http://{host}:{port}/metrics" {
+		t.Errorf("unexpected check %+v", s.Check)
+	}
+
+	s = &registry.Service{Name: "job", Check: registry.DefaultCheck()}
+	if res := e.Apply(s, &Context{Framework: "chronos"}); !res.Skip {
+		t.Errorf("chronos services should be skipped")
+	}
+
+	s = &registry.Service{Name: "web", Check: registry.DefaultCheck()}
+	e.Apply(s, &Context{PortName: "metrics"})
+	if s.Name != "web" {
+		t.Errorf("rule shouldn't match without the team label")
+	}
+}
+
+func TestNew_InvalidRegexp(t *testing.T) {
+	if _, err := New([]Rule{{Match: Match{TaskName: "("}}}); err == nil {
+		t.Errorf("New() should fail on invalid regular expressions")
+	}
+}
+
+func TestNew_InvalidAddressSource(t *testing.T) {
+	if _, err := New([]Rule{{Actions: Actions{AddressSource: "dokcer"}}}); err == nil {
+		t.Errorf("New() should fail on unknown address sources")
+	}
+
+	for _, src := range []string{"", "netinfo", "host", "docker", "mesos"} {
+		if _, err := New([]Rule{{Actions: Actions{AddressSource: src}}}); err != nil {
+			t.Errorf("address source %q: %s", src, err)
+		}
+	}
+}
+
+func TestEngine_Rename(t *testing.T) {
+	e, err := New([]Rule{
+		{Match: Match{Framework: "^chronos$"}, Actions: Actions{Skip: true}},
+		{Match: Match{TaskName: "^web"}, Actions: Actions{Rename: "frontend"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name := e.Rename(&Context{TaskName: "web", Framework: "marathon"}); name != "frontend" {
+		t.Errorf("Rename() = %q, want frontend", name)
+	}
+	if name := e.Rename(&Context{TaskName: "web", Framework: "chronos"}); name != "" {
+		t.Errorf("Rename() of a skipped service = %q, want none", name)
+	}
+	if name := e.Rename(&Context{TaskName: "api"}); name != "" {
+		t.Errorf("Rename() = %q, want none", name)
+	}
+}
@@ -11,7 +11,11 @@ import (
 
 // Resources holds resources as defined in the /state.json Mesos HTTP endpoint.
 type Resources struct {
-	PortRanges string `json:"ports"`
+	PortRanges string  `json:"ports"`
+	CPUs       float64 `json:"cpus"`
+	Mem        float64 `json:"mem"`
+	Disk       float64 `json:"disk"`
+	GPUs       float64 `json:"gpus"`
 }
 
 // Ports returns a slice of individual ports expanded from PortRanges.
@@ -49,6 +53,7 @@ type Label struct {
 type Status struct {
 	Timestamp       float64         `json:"timestamp"`
 	State           string          `json:"state"`
+	Healthy         *bool           `json:"healthy,omitempty"`
 	Labels          []Label         `json:"labels,omitempty"`
 	ContainerStatus ContainerStatus `json:"container_status,omitempty"`
 }
@@ -73,6 +78,41 @@ type IPAddress struct {
 	IPAddress string `json:"ip_address,omitempty"`
 }
 
+// Container holds the container of a task as defined in the /state.json
+// Mesos HTTP endpoint.
+type Container struct {
+	Type    string     `json:"type"`
+	Docker  DockerInfo `json:"docker"`
+	Mesos   MesosInfo  `json:"mesos"`
+	Volumes []Volume   `json:"volumes"`
+}
+
+// DockerInfo holds the settings of a Docker container.
+type DockerInfo struct {
+	Image   string `json:"image"`
+	Network string `json:"network"`
+}
+
+// Volume holds a volume mounted in a container.
+type Volume struct {
+	ContainerPath string `json:"container_path"`
+	HostPath      string `json:"host_path"`
+	Mode          string `json:"mode"`
+}
+
+// MesosInfo holds the settings of a Mesos container.
+type MesosInfo struct {
+	Image Image `json:"image"`
+}
+
+// Image holds the image of a Mesos container.
+type Image struct {
+	Type   string `json:"type"`
+	Docker struct {
+		Name string `json:"name"`
+	} `json:"docker"`
+}
+
 // Task holds a task as defined in the /state.json Mesos HTTP endpoint.
 type Task struct {
 	FrameworkID   string   `json:"framework_id"`
@@ -84,8 +124,11 @@ type Task struct {
 	Labels        []Label  `json:"labels"`
 	Resources     `json:"resources"`
 	DiscoveryInfo DiscoveryInfo `json:"discovery"`
+	Container     Container     `json:"container"`
 
-	SlaveIP string `json:"-"`
+	SlaveIP       string `json:"-"`
+	SlaveHostname string `json:"-"`
+	FrameworkName string `json:"-"`
 }
 
 // HasDiscoveryInfo return whether the DiscoveryInfo was provided in the state.json
@@ -130,6 +173,46 @@ func (t *Task) Label(name string) string {
 	return ""
 }
 
+// Image returns the Docker image of the task, run by the Docker or the Mesos
+// containerizer.
+func (t *Task) Image() string {
+	if t.Container.Docker.Image != "" {
+		return t.Container.Docker.Image
+	}
+
+	return t.Container.Mesos.Image.Docker.Name
+}
+
+// SplitImage splits a Docker image reference into its name and tag. The
+// digest, if any, is dropped.
+func SplitImage(image string) (name, tag string) {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+
+	// A colon before the last slash separates the registry port
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i], image[i+1:]
+	}
+
+	return image, ""
+}
+
+// Healthy returns the health of the latest status, nil when it's unknown.
+func (t *Task) Healthy() *bool {
+	var latest *Status
+	for i := range t.Statuses {
+		if latest == nil || t.Statuses[i].Timestamp >= latest.Timestamp {
+			latest = &t.Statuses[i]
+		}
+	}
+
+	if latest == nil {
+		return nil
+	}
+	return latest.Healthy
+}
+
 // sources maps the string representation of IP sources to their functions.
 var sources = map[string]func(*Task) []string{
 	"host":    hostIPs,
@@ -218,6 +301,7 @@ func labels(key string) func(*Status) []string {
 
 // Framework holds a framework as defined in the /state.json Mesos HTTP endpoint.
 type Framework struct {
+	ID       string `json:"id"`
 	Tasks    []Task `json:"tasks"`
 	PID      PID    `json:"pid"`
 	Name     string `json:"name"`
@@ -235,9 +319,15 @@ func (f Framework) HostPort() (string, string) {
 
 // Slave holds a slave as defined in the /state.json Mesos HTTP endpoint.
 type Slave struct {
-	ID       string `json:"id"`
-	Hostname string `json:"hostname"`
-	PID      PID    `json:"pid"`
+	ID         string                 `json:"id"`
+	Hostname   string                 `json:"hostname"`
+	PID        PID                    `json:"pid"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+// Slaves holds the agent list as defined in the /master/slaves Mesos HTTP endpoint.
+type Slaves struct {
+	Slaves []Slave `json:"slaves"`
 }
 
 // PID holds a Mesos PID and implements the json.Unmarshaler interface.
@@ -254,6 +344,67 @@ type State struct {
 	Frameworks []Framework `json:"frameworks"`
 	Slaves     []Slave     `json:"slaves"`
 	Leader     string      `json:"leader"`
+
+	// Unreachable holds the slaves whose state could not be polled when
+	// the state is assembled from the agents instead of the master.
+	Unreachable []Slave `json:"-"`
+}
+
+// AddSlaveState merges the tasks known by a single agent into the state,
+// grouping them under their framework.
+func (s *State) AddSlaveState(ss SlaveState) {
+	for _, sf := range ss.Frameworks {
+		var fw *Framework
+		for i := range s.Frameworks {
+			if s.Frameworks[i].ID == sf.ID {
+				fw = &s.Frameworks[i]
+				break
+			}
+		}
+		if fw == nil {
+			s.Frameworks = append(s.Frameworks, Framework{
+				ID:       sf.ID,
+				Name:     sf.Name,
+				Hostname: sf.Hostname,
+			})
+			fw = &s.Frameworks[len(s.Frameworks)-1]
+		}
+
+		for _, e := range sf.Executors {
+			for _, t := range e.Tasks {
+				if t.SlaveID == "" {
+					t.SlaveID = ss.ID
+				}
+				if t.FrameworkID == "" {
+					t.FrameworkID = sf.ID
+				}
+				fw.Tasks = append(fw.Tasks, t)
+			}
+		}
+	}
+}
+
+// SlaveState holds the state defined in the /slave(1)/state Mesos HTTP endpoint.
+type SlaveState struct {
+	ID         string           `json:"id"`
+	Hostname   string           `json:"hostname"`
+	Frameworks []SlaveFramework `json:"frameworks"`
+}
+
+// SlaveFramework holds a framework as defined in the /slave(1)/state Mesos
+// HTTP endpoint.
+type SlaveFramework struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Hostname  string     `json:"hostname"`
+	Executors []Executor `json:"executors"`
+}
+
+// Executor holds an executor and its active tasks as defined in the
+// /slave(1)/state Mesos HTTP endpoint.
+type Executor struct {
+	ID    string `json:"id"`
+	Tasks []Task `json:"tasks"`
 }
 
 // DiscoveryInfo holds the discovery meta data for a task defined in the /state.json Mesos HTTP endpoint.
@@ -277,3 +428,49 @@ type DiscoveryPort struct {
 	Number   int    `json:"number"`
 	Name     string `json:"name"`
 }
+
+// MachineID holds a machine ID as defined in the /maintenance Mesos HTTP endpoints.
+type MachineID struct {
+	Hostname string `json:"hostname"`
+	IP       string `json:"ip"`
+}
+
+// Nanoseconds holds a time or a duration as defined in the /maintenance
+// Mesos HTTP endpoints.
+type Nanoseconds struct {
+	Nanoseconds int64 `json:"nanoseconds"`
+}
+
+// Unavailability holds an unavailability as defined in the /maintenance/schedule
+// Mesos HTTP endpoint. A missing duration means the machine is unavailable
+// for an unknown amount of time.
+type Unavailability struct {
+	Start    Nanoseconds  `json:"start"`
+	Duration *Nanoseconds `json:"duration,omitempty"`
+}
+
+// MaintenanceWindow holds a window as defined in the /maintenance/schedule
+// Mesos HTTP endpoint.
+type MaintenanceWindow struct {
+	MachineIDs     []MachineID    `json:"machine_ids"`
+	Unavailability Unavailability `json:"unavailability"`
+}
+
+// MaintenanceSchedule holds the schedule as defined in the /maintenance/schedule
+// Mesos HTTP endpoint.
+type MaintenanceSchedule struct {
+	Windows []MaintenanceWindow `json:"windows"`
+}
+
+// DrainingMachine holds a draining machine as defined in the /maintenance/status
+// Mesos HTTP endpoint.
+type DrainingMachine struct {
+	ID MachineID `json:"id"`
+}
+
+// MaintenanceStatus holds the status as defined in the /maintenance/status
+// Mesos HTTP endpoint.
+type MaintenanceStatus struct {
+	DrainingMachines []DrainingMachine `json:"draining_machines"`
+	DownMachines     []MachineID       `json:"down_machines"`
+}
@@ -111,6 +111,44 @@ func TestTask_IPs(t *testing.T) {
 	}
 }
 
+func TestState_AddSlaveState(t *testing.T) {
+	var s State
+
+	s.AddSlaveState(SlaveState{
+		ID: "S1",
+		Frameworks: []SlaveFramework{
+			{ID: "F1", Name: "marathon", Executors: []Executor{
+				{Tasks: []Task{{ID: "a"}, {ID: "b"}}},
+			}},
+		},
+	})
+	s.AddSlaveState(SlaveState{
+		ID: "S2",
+		Frameworks: []SlaveFramework{
+			{ID: "F1", Name: "marathon", Executors: []Executor{
+				{Tasks: []Task{{ID: "c", SlaveID: "S2", FrameworkID: "F1"}}},
+			}},
+			{ID: "F2", Name: "chronos", Executors: []Executor{
+				{Tasks: []Task{{ID: "d"}}},
+			}},
+		},
+	})
+
+	want := []Framework{
+		{ID: "F1", Name: "marathon", Tasks: []Task{
+			{ID: "a", SlaveID: "S1", FrameworkID: "F1"},
+			{ID: "b", SlaveID: "S1", FrameworkID: "F1"},
+			{ID: "c", SlaveID: "S2", FrameworkID: "F1"},
+		}},
+		{ID: "F2", Name: "chronos", Tasks: []Task{
+			{ID: "d", SlaveID: "S2", FrameworkID: "F2"},
+		}},
+	}
+	if got := s.Frameworks; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got: %+v, want: %+v", got, want)
+	}
+}
+
 // test helpers
 
 type (
@@ -179,3 +217,35 @@ func netinfo(ips ...string) statusOpt {
 func timestamp(t float64) statusOpt {
 	return func(s *Status) { s.Timestamp = t }
 }
+
+func TestTask_Healthy(t *testing.T) {
+	var task Task
+	if task.Healthy() != nil {
+		t.Errorf("Healthy() of a task without status should be nil")
+	}
+
+	if err := json.Unmarshal([]byte(`{"statuses": [
+		{"state": "TASK_RUNNING", "timestamp": 2, "healthy": false},
+		{"state": "TASK_RUNNING", "timestamp": 1, "healthy": true}
+	]}`), &task); err != nil {
+		t.Fatal(err)
+	}
+
+	if h := task.Healthy(); h == nil || *h {
+		t.Errorf("Healthy() should be the health of the latest status")
+	}
+}
+
+func TestSplitImage(t *testing.T) {
+	for _, tc := range []struct{ image, name, tag string }{
+		{"nginx", "nginx", ""},
+		{"nginx:1.13", "nginx", "1.13"},
+		{"registry:5000/team/web", "registry:5000/team/web", ""},
+		{"registry:5000/team/web:v2", "registry:5000/team/web", "v2"},
+		{"web:v2@sha256:abcd", "web", "v2"},
+	} {
+		if name, tag := SplitImage(tc.image); name != tc.name || tag != tc.tag {
+			t.Errorf("SplitImage(%q) = %q, %q, want %q, %q", tc.image, name, tag, tc.name, tc.tag)
+		}
+	}
+}